@@ -0,0 +1,193 @@
+package wasi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AdminConfig enables the admin API, which lists loaded modules and reloads,
+// unloads, drains or rolls them back. Every request must carry
+// "Authorization: Bearer <Token>"; without a Token the API is not mounted.
+type AdminConfig struct {
+	Token string
+	Path  string // route prefix, default "/admin"
+	Port  string // serve on this port, on the main server's host, instead of the main server
+	Addr  string // serve on this address instead, in SetListenAddr form; overrides Port
+}
+
+// ModuleInfo is the admin view of a loaded module.
+type ModuleInfo struct {
+	Name          string         `json:"name"`
+	Middleware    bool           `json:"middleware"`
+	Rule          *Rule          `json:"rule,omitempty"`
+	Exports       []string       `json:"exports"`
+	Active        int32          `json:"active"` // calls in flight
+	Healthy       bool           `json:"healthy"`
+	Crashes       uint64         `json:"crashes"`
+	Instances     int            `json:"instances"` // pooled instances
+	Subscriptions []Subscription `json:"subscriptions"`
+	Version       *Version       `json:"version,omitempty"`
+	Canary        *CanaryConfig  `json:"canary,omitempty"`
+}
+
+// SetAdmin configures the admin API. Call before StartServer.
+func (s *WasiServer) SetAdmin(cfg AdminConfig) *WasiServer {
+	if cfg.Path == "" {
+		cfg.Path = "/admin"
+	}
+	cfg.Path = "/" + strings.Trim(cfg.Path, "/")
+	s.admin = cfg
+	return s
+}
+
+// Modules describes every loaded module and middleware, sorted by name.
+func (s *WasiServer) Modules() []ModuleInfo {
+	var infos []ModuleInfo
+	s.mu.RLock()
+	for name, mod := range s.modules {
+		info := s.moduleInfoLocked(name, mod)
+		if c := s.canaries[name]; c != nil {
+			cfg := c.cfg
+			info.Canary = &cfg
+		}
+		infos = append(infos, info)
+	}
+	s.mu.RUnlock()
+
+	s.muMw.RLock()
+	mws := append([]*MiddlewareModule(nil), s.middlewares...)
+	s.muMw.RUnlock()
+	s.mu.RLock()
+	for _, mw := range mws {
+		info := s.moduleInfoLocked(mw.Module.name, mw.Module)
+		info.Middleware = true
+		rule := mw.Rule
+		info.Rule = &rule
+		infos = append(infos, info)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// moduleInfoLocked describes mod, loaded as name. s.mu must be held.
+func (s *WasiServer) moduleInfoLocked(name string, mod *Module) ModuleInfo {
+	info := ModuleInfo{
+		Name:          name,
+		Exports:       mod.Exports(),
+		Active:        mod.active.Load(),
+		Healthy:       mod.Healthy(),
+		Crashes:       mod.Crashes(),
+		Instances:     mod.pool.size(),
+		Subscriptions: mod.Subscriptions(),
+	}
+	if h := s.history[name]; h != nil && h.current != nil {
+		v := h.current.Version
+		v.Current = true
+		info.Version = &v
+	}
+	return info
+}
+
+// ReloadModule swaps in module name again from its .wasm in the output directory.
+func (s *WasiServer) ReloadModule(name string) error {
+	file := filepath.Join(s.outputDir, name+".wasm")
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return s.swapModuleFrom(name, bytes, file)
+}
+
+// registerAdmin mounts the admin routes on mux under the configured prefix.
+func (s *WasiServer) registerAdmin(mux *http.ServeMux) {
+	p := s.admin.Path
+	mux.HandleFunc("GET "+p+"/modules", s.adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Modules())
+	}))
+	mux.HandleFunc("GET "+p+"/modules/{name}/versions", s.adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		vs := s.Versions(r.PathValue("name"))
+		if vs == nil {
+			adminError(w, ErrModuleNotLoaded)
+			return
+		}
+		writeJSON(w, http.StatusOK, vs)
+	}))
+	mux.HandleFunc("POST "+p+"/modules/{name}/{action}", s.adminAuth(s.handleAdminAction))
+}
+
+func (s *WasiServer) handleAdminAction(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var err error
+	switch r.PathValue("action") {
+	case "reload":
+		err = s.ReloadModule(name)
+	case "unload":
+		err = s.UnloadModule(name)
+	case "drain":
+		mod := s.loadedModule(name, false)
+		if mod == nil {
+			mod = s.loadedModule(name, true)
+		}
+		if mod == nil {
+			err = ErrModuleNotLoaded
+		} else {
+			err = mod.Drain(context.Background(), s.drainTimeout)
+		}
+	case "rollback":
+		var n int
+		if n, err = strconv.Atoi(r.URL.Query().Get("version")); err != nil {
+			http.Error(w, "version query parameter required", http.StatusBadRequest)
+			return
+		}
+		err = s.Rollback(name, n)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+	s.logger("Admin:", r.PathValue("action"), name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// adminAuth rejects requests without the configured bearer token.
+func (s *WasiServer) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + s.admin.Token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func adminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrModuleNotLoaded), errors.Is(err, ErrUnknownVersion), errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrDrainTimeout):
+		status = http.StatusGatewayTimeout
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,125 @@
+package wasi
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func adminDo(t *testing.T, mux *http.ServeMux, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestWasiServer_Admin(t *testing.T) {
+	srv := New().SetAppRootDir(t.TempDir()).SetAdmin(AdminConfig{Token: "s3cret", Path: "ops/"})
+	srv.swapModule("users", staticHandleWasm("v1"))
+	srv.swapModule("users", staticHandleWasm("v2"))
+	mux := http.NewServeMux()
+	srv.registerAdmin(mux)
+
+	if rec := adminDo(t, mux, "GET", "/ops/modules", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status %d, want 401", rec.Code)
+	}
+	if rec := adminDo(t, mux, "GET", "/ops/modules", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want 401", rec.Code)
+	}
+
+	rec := adminDo(t, mux, "GET", "/ops/modules", "s3cret")
+	var infos []ModuleInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("list: %v: %s", err, rec.Body)
+	}
+	if len(infos) != 1 || infos[0].Name != "users" || infos[0].Version == nil || infos[0].Version.Version != 2 {
+		t.Fatalf("modules = %+v", infos)
+	}
+	if len(infos[0].Exports) != 2 || infos[0].Exports[0] != "handle" {
+		t.Errorf("exports = %v", infos[0].Exports)
+	}
+
+	if rec := adminDo(t, mux, "POST", "/ops/modules/users/rollback?version=1", "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("rollback: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := dispatchBody(srv, httptest.NewRequest("GET", "/m/users", nil)); got != "v1" {
+		t.Errorf("after rollback served by %q, want v1", got)
+	}
+	if rec := adminDo(t, mux, "POST", "/ops/modules/users/rollback?version=9", "s3cret"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown version: status %d, want 404", rec.Code)
+	}
+	if rec := adminDo(t, mux, "POST", "/ops/modules/users/drain", "s3cret"); rec.Code != http.StatusOK {
+		t.Errorf("drain: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := adminDo(t, mux, "POST", "/ops/modules/users/unload", "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("unload: status %d: %s", rec.Code, rec.Body)
+	}
+	if srv.loadedModule("users", false) != nil {
+		t.Error("module still loaded after unload")
+	}
+	if rec := adminDo(t, mux, "POST", "/ops/modules/users/unload", "s3cret"); rec.Code != http.StatusNotFound {
+		t.Errorf("second unload: status %d, want 404", rec.Code)
+	}
+}
+
+func adminGet(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	r, _ := http.NewRequest("GET", url, nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWasiServer_AdminListener(t *testing.T) {
+	tmp := t.TempDir()
+	srv := New().SetAppRootDir(tmp).SetOutputDir(tmp).SetListenAddr("127.0.0.1:0").
+		SetAdmin(AdminConfig{Token: "s3cret", Port: "0"})
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+
+	// With Port only, the admin API binds the main server's host.
+	host, _, _ := net.SplitHostPort(srv.adminSrv.Addr)
+	if host != "127.0.0.1" {
+		t.Fatalf("admin bound to %s, want the main server's 127.0.0.1", srv.adminSrv.Addr)
+	}
+	if got := adminGet(t, http.DefaultClient, "http://"+srv.adminSrv.Addr+"/admin/modules"); got != http.StatusOK {
+		t.Errorf("GET /admin/modules on the admin port = %d", got)
+	}
+	if got := adminGet(t, http.DefaultClient, "http://"+srv.Addr().String()+"/admin/modules"); got != http.StatusNotFound {
+		t.Errorf("GET /admin/modules on the main port = %d, want 404", got)
+	}
+}
+
+func TestWasiServer_AdminUnixSocket(t *testing.T) {
+	tmp := t.TempDir()
+	sock := filepath.Join(tmp, "admin.sock")
+	srv := New().SetAppRootDir(tmp).SetOutputDir(tmp).SetListenAddr("127.0.0.1:0").
+		SetAdmin(AdminConfig{Token: "s3cret", Port: "6061", Addr: "unix:" + sock})
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	if got := adminGet(t, client, "http://admin/admin/modules"); got != http.StatusOK {
+		t.Errorf("GET /admin/modules over the admin socket = %d", got)
+	}
+}
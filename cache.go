@@ -0,0 +1,86 @@
+package wasi
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// CompilationCache shares compiled machine code across module runtimes and
+// persists it in a directory, so unchanged modules skip recompilation on
+// hot-reload and restart.
+type CompilationCache struct {
+	dir    string
+	cache  wazero.CompilationCache
+	mu     sync.Mutex // serializes compiles so each one's effect on dir is its own
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// CacheStats reports how many compiles wazero served from the cache (Hits)
+// and how many it had to compile and store (Misses).
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// NewCompilationCache opens (or creates) a compilation cache in dir.
+func NewCompilationCache(dir string) (*CompilationCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CompilationCache{dir: dir, cache: cache}, nil
+}
+
+// Stats returns the hit/miss counters since the cache was opened.
+func (c *CompilationCache) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// Close releases the cache. Compiled code stays on disk.
+func (c *CompilationCache) Close(ctx context.Context) error {
+	return c.cache.Close(ctx)
+}
+
+// compile compiles wasmBytes in r, whose config uses this cache, and counts
+// the result. wazero keeps its entries opaque, but it writes one whenever it
+// has to compile: a compile that leaves the cache directory unchanged was
+// served from it.
+func (c *CompilationCache) compile(ctx context.Context, r wazero.Runtime, wasmBytes []byte) (wazero.CompiledModule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before := c.entries()
+	compiled, err := r.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+	// An empty directory means wazero stores nothing here (e.g. its
+	// interpreter), so nothing was served from it either.
+	if after := c.entries(); after > 0 && after == before {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return compiled, nil
+}
+
+// entries counts the files wazero has stored in the cache directory.
+func (c *CompilationCache) entries() int {
+	n := 0
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
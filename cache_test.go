@@ -0,0 +1,78 @@
+package wasi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinywasm/bus"
+)
+
+func TestCompilationCache_HitsAcrossRuntimes(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wasi-cache")
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	wasm := blockingHandleWasm()
+	load := func(cache *CompilationCache) {
+		mod, err := LoadWithConfig(ctx, "cached", wasm, NewHostBuilder(bus.New(), nil, nil), LoadConfig{Cache: cache})
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		mod.Close(ctx)
+	}
+
+	cache, err := NewCompilationCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load(cache)
+	load(cache)
+	if got := cache.Stats(); got != (CacheStats{Hits: 1, Misses: 1}) {
+		t.Errorf("stats = %+v, want 1 hit 1 miss", got)
+	}
+	cache.Close(ctx)
+
+	// A new cache over the same directory, as after a restart.
+	reopened, err := NewCompilationCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load(reopened)
+	if got := reopened.Stats(); got != (CacheStats{Hits: 1}) {
+		t.Errorf("stats after reopen = %+v, want 1 hit", got)
+	}
+	reopened.Close(ctx)
+
+	// Without wazero's files the module must be compiled again.
+	stored, _ := filepath.Glob(filepath.Join(dir, "wazero-*"))
+	if len(stored) == 0 {
+		t.Fatal("wazero stored nothing in the cache directory")
+	}
+	for _, path := range stored {
+		os.RemoveAll(path)
+	}
+	wiped, err := NewCompilationCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wiped.Close(ctx)
+	load(wiped)
+	if got := wiped.Stats(); got != (CacheStats{Misses: 1}) {
+		t.Errorf("stats after wiping the cache = %+v, want 1 miss", got)
+	}
+}
+
+func TestWasiServer_CompilationCacheDir(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wasi-cache-srv")
+	defer os.RemoveAll(dir)
+
+	srv := New().SetCompilationCacheDir(dir)
+	srv.swapModule("test", emptyWasm)
+	srv.swapModule("test", emptyWasm)
+
+	if got := srv.CacheStats(); got != (CacheStats{Hits: 1, Misses: 1}) {
+		t.Errorf("stats = %+v, want 1 hit 1 miss", got)
+	}
+}
@@ -0,0 +1,136 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+)
+
+var ErrNoCanary = errors.New("wasi: no canary deployed")
+
+// CanaryConfig selects the /m/{name} requests served by a canary.
+// A request matching Header or Cookie always goes to the canary; the rest
+// go to it with probability Percent/100.
+type CanaryConfig struct {
+	Percent     int    // 0-100
+	Header      string // optional request header name
+	HeaderValue string // required value; empty matches any non-empty value
+	Cookie      string // optional cookie name
+	CookieValue string // required value; empty matches any non-empty value
+}
+
+type canary struct {
+	mod   *Module
+	cfg   CanaryConfig
+	bytes []byte
+}
+
+func (c CanaryConfig) matches(r *http.Request) bool {
+	if c.Header != "" {
+		if v := r.Header.Get(c.Header); v != "" && (c.HeaderValue == "" || v == c.HeaderValue) {
+			return true
+		}
+	}
+	if c.Cookie != "" {
+		if ck, err := r.Cookie(c.Cookie); err == nil && ck.Value != "" && (c.CookieValue == "" || ck.Value == c.CookieValue) {
+			return true
+		}
+	}
+	return c.Percent > 0 && rand.IntN(100) < c.Percent
+}
+
+// DeployCanary loads wasmBytes as a second version of module name, next to the
+// one currently serving, and routes the requests selected by cfg to it.
+// Bus messages stay with the current version: the canary's subscriptions are
+// only made when it is promoted. A canary already deployed for name is replaced.
+func (s *WasiServer) DeployCanary(name string, wasmBytes []byte, cfg CanaryConfig) error {
+	l := s.swapLock(name)
+	l.Lock()
+	defer l.Unlock()
+	if s.loadedModule(name, false) == nil {
+		return errors.New("wasi: module " + name + " is not loaded")
+	}
+	ctx := context.Background()
+	mod, err := s.loadModule(ctx, name, wasmBytes, true)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.canaries[name]
+	s.canaries[name] = &canary{mod: mod, cfg: cfg, bytes: wasmBytes}
+	s.mu.Unlock()
+
+	if old != nil {
+		s.retire(ctx, old.mod)
+	}
+	s.logger("Canary deployed:", name)
+	return nil
+}
+
+// PromoteCanary makes the canary of name serve all traffic, then drains and
+// closes the version it replaces.
+func (s *WasiServer) PromoteCanary(name string) error {
+	l := s.swapLock(name)
+	l.Lock()
+	defer l.Unlock()
+	s.mu.Lock()
+	c := s.canaries[name]
+	if c == nil {
+		s.mu.Unlock()
+		return ErrNoCanary
+	}
+	delete(s.canaries, name)
+	old := s.modules[name]
+	s.modules[name] = c.mod
+	s.recordVersionLocked(name, c.bytes, "", nil)
+	s.mu.Unlock()
+	c.mod.connectSubscriptions()
+
+	if old != nil {
+		s.retire(context.Background(), old)
+	}
+	s.logger("Canary promoted:", name)
+	return nil
+}
+
+// RollbackCanary stops routing to the canary of name, then drains and closes it.
+func (s *WasiServer) RollbackCanary(name string) error {
+	l := s.swapLock(name)
+	l.Lock()
+	defer l.Unlock()
+	s.mu.Lock()
+	c := s.canaries[name]
+	delete(s.canaries, name)
+	s.mu.Unlock()
+	if c == nil {
+		return ErrNoCanary
+	}
+
+	s.retire(context.Background(), c.mod)
+	s.logger("Canary rolled back:", name)
+	return nil
+}
+
+// Canary returns the routing config of the canary deployed for name.
+func (s *WasiServer) Canary(name string) (CanaryConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := s.canaries[name]
+	if c == nil {
+		return CanaryConfig{}, false
+	}
+	return c.cfg, true
+}
+
+// targetModule returns the module that serves r for /m/{name}: the canary when
+// one is deployed and selects r, otherwise the current module.
+func (s *WasiServer) targetModule(name string, r *http.Request) *Module {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c := s.canaries[name]; c != nil && c.cfg.matches(r) {
+		return c.mod
+	}
+	return s.modules[name]
+}
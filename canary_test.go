@@ -0,0 +1,149 @@
+package wasi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tinywasm/binary"
+)
+
+// staticHandleWasm exports handle(), which always responds with body.
+func staticHandleWasm(body string) []byte {
+	f := &wasmFixture{}
+	f.memory(1).dataAt(16, encodeResponse(&Response{Body: []byte(body)}))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, i32Const(16)...)
+	return f.bytes()
+}
+
+func dispatchBody(srv *WasiServer, r *http.Request) string {
+	rec := httptest.NewRecorder()
+	srv.handleMiddlewareDispatch(rec, r)
+	return rec.Body.String()
+}
+
+func TestWasiServer_Canary(t *testing.T) {
+	srv := New().SetAppRootDir(t.TempDir())
+	if err := srv.DeployCanary("users", staticHandleWasm("v2"), CanaryConfig{}); err == nil {
+		t.Error("DeployCanary succeeded without a current module")
+	}
+	if err := srv.swapModule("users", staticHandleWasm("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.DeployCanary("users", staticHandleWasm("v2"), CanaryConfig{Header: "X-Canary", HeaderValue: "1", Cookie: "canary"}); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := httptest.NewRequest("GET", "/m/users", nil)
+	if got := dispatchBody(srv, plain); got != "v1" {
+		t.Errorf("plain request served by %q, want v1", got)
+	}
+	byHeader := httptest.NewRequest("GET", "/m/users", nil)
+	byHeader.Header.Set("X-Canary", "1")
+	if got := dispatchBody(srv, byHeader); got != "v2" {
+		t.Errorf("X-Canary request served by %q, want v2", got)
+	}
+	byCookie := httptest.NewRequest("GET", "/m/users", nil)
+	byCookie.AddCookie(&http.Cookie{Name: "canary", Value: "yes"})
+	if got := dispatchBody(srv, byCookie); got != "v2" {
+		t.Errorf("cookie request served by %q, want v2", got)
+	}
+
+	if err := srv.RollbackCanary("users"); err != nil {
+		t.Fatal(err)
+	}
+	if got := dispatchBody(srv, byHeader); got != "v1" {
+		t.Errorf("after rollback served by %q, want v1", got)
+	}
+	if err := srv.RollbackCanary("users"); err != ErrNoCanary {
+		t.Errorf("second rollback = %v, want ErrNoCanary", err)
+	}
+
+	if err := srv.DeployCanary("users", staticHandleWasm("v3"), CanaryConfig{Percent: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dispatchBody(srv, plain); got != "v3" {
+		t.Errorf("100%% canary served by %q, want v3", got)
+	}
+	if err := srv.PromoteCanary("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Canary("users"); ok {
+		t.Error("canary still deployed after promote")
+	}
+	if got := dispatchBody(srv, plain); got != "v3" {
+		t.Errorf("after promote served by %q, want v3", got)
+	}
+}
+
+// versionSubscriberWasm subscribes to "t" in init() and logs version for each message.
+func versionSubscriberWasm(version string) []byte {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1).dataAt(0, []byte("t")).dataAt(16, []byte(version))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil, ops(
+		i32Const(16), i32Const(int32(len(version))), call(logFn),
+	)...)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(1), i32Const(0), call(subFn), drop(),
+	)...)
+	return f.bytes()
+}
+
+func TestWasiServer_CanaryStaysOffTheBus(t *testing.T) {
+	handled := make(chan any, 8)
+	srv := New().SetAppRootDir(t.TempDir()).SetLogger(func(msg ...any) {
+		if len(msg) == 2 && msg[0] == "[WASI]" {
+			handled <- msg[1]
+		}
+	})
+	if err := srv.swapModule("users", versionSubscriberWasm("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.DeployCanary("users", versionSubscriberWasm("v2"), CanaryConfig{Percent: 50}); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		srv.bus.Publish("t", binary.Message{Payload: []byte("x")})
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Errorf("message handled by %v, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message not handled, want %s", want)
+		}
+		select {
+		case got := <-handled:
+			t.Errorf("message handled a second time, by %v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	expect("v1")
+	if err := srv.PromoteCanary("users"); err != nil {
+		t.Fatal(err)
+	}
+	expect("v2")
+}
+
+func TestCanaryConfig_Percent(t *testing.T) {
+	r := httptest.NewRequest("GET", "/m/users", nil)
+	if (CanaryConfig{}).matches(r) {
+		t.Error("0% canary matched")
+	}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if (CanaryConfig{Percent: 30}).matches(r) {
+			hits++
+		}
+	}
+	if hits < 200 || hits > 400 {
+		t.Errorf("30%% canary matched %d of 1000 requests", hits)
+	}
+}
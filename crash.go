@@ -0,0 +1,99 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrModuleUnhealthy is returned for calls into a module that crashed more
+// often than its RestartPolicy allows, until its backoff expires.
+var ErrModuleUnhealthy = errors.New("wasi: module unhealthy after repeated crashes")
+
+// RestartPolicy bounds how often a module's crashed instances are replaced.
+// An instance that traps is always closed, since its memory may be corrupt,
+// and the next call gets a fresh one from the compiled module. More than
+// MaxRestarts crashes within Window mark the module unhealthy: its calls fail
+// with ErrModuleUnhealthy for Backoff, then restarts are allowed again.
+// The zero value restarts without limit.
+type RestartPolicy struct {
+	MaxRestarts int
+	Window      time.Duration
+	Backoff     time.Duration // default Window
+}
+
+// restartTracker applies a RestartPolicy to one module.
+type restartTracker struct {
+	mu        sync.Mutex
+	policy    RestartPolicy
+	restarts  []time.Time // within policy.Window
+	downUntil time.Time
+}
+
+// record counts a restart at now and reports whether the module is still healthy.
+func (t *restartTracker) record(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.policy
+	if p.MaxRestarts <= 0 {
+		return true
+	}
+	kept := t.restarts[:0]
+	for _, at := range t.restarts {
+		if now.Sub(at) < p.Window {
+			kept = append(kept, at)
+		}
+	}
+	t.restarts = append(kept, now)
+	if len(t.restarts) <= p.MaxRestarts {
+		return true
+	}
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = p.Window
+	}
+	t.downUntil = now.Add(backoff)
+	t.restarts = t.restarts[:0]
+	return false
+}
+
+func (t *restartTracker) healthy(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !now.Before(t.downUntil)
+}
+
+// isTrap reports whether err is a guest trap: wazero reports those as
+// "wasm error: ..." followed by the guest stack trace.
+func isTrap(err error) bool {
+	return err != nil && !errors.Is(err, ErrCallTimeout) && strings.Contains(err.Error(), "wasm error:")
+}
+
+// Healthy reports whether the module accepts calls; see RestartPolicy.
+func (m *Module) Healthy() bool {
+	return m.restarts.healthy(time.Now())
+}
+
+// Crashes returns how many times the module's instances have trapped.
+func (m *Module) Crashes() uint64 {
+	return m.crashes.Load()
+}
+
+// crash closes inst after it trapped with err, so the pool replaces it, and
+// logs err with its guest stack trace.
+func (m *Module) crash(ctx context.Context, inst *instance, err error) {
+	inst.mod.Close(ctx)
+	m.crashes.Add(1)
+	healthy := m.restarts.record(time.Now())
+	if m.logger == nil {
+		return
+	}
+	m.logger(fmt.Sprintf("Module %s crashed: %v", m.name, err))
+	if !healthy {
+		p := m.restarts.policy
+		m.logger(fmt.Sprintf("Module %s unhealthy: more than %d crashes within %s", m.name, p.MaxRestarts, p.Window))
+	}
+}
@@ -0,0 +1,69 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tinywasm/bus"
+)
+
+func TestModule_TrapReplacesInstance(t *testing.T) {
+	ctx := context.Background()
+	var logs logRecorder
+	hb := NewHostBuilder(bus.New(), nil, func(...any) {})
+	mod, err := LoadWithConfig(ctx, "broken", trapHandleWasm(), hb, LoadConfig{Logger: logs.log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+	first := mod.pool.instances()[0]
+
+	if _, err := mod.Handle(ctx, &Request{Method: "GET"}); err == nil {
+		t.Fatal("trapping handle returned no error")
+	}
+	if mod.Crashes() != 1 || !first.mod.IsClosed() || mod.pool.size() != 0 {
+		t.Errorf("crashes = %d, closed = %v, pool = %d; want 1, true, 0", mod.Crashes(), first.mod.IsClosed(), mod.pool.size())
+	}
+	if !logs.contains("Module broken crashed:") || !logs.contains("wasm stack trace") {
+		t.Errorf("crash not logged with a stack trace: %q", logs.lines())
+	}
+
+	// A closed instance would fail with "module closed"; a fresh one traps again.
+	if _, err := mod.Handle(ctx, &Request{Method: "GET"}); !isTrap(err) || mod.Crashes() != 2 {
+		t.Errorf("second call = %v, crashes = %d; want a trap from a fresh instance", err, mod.Crashes())
+	}
+	if !mod.Healthy() {
+		t.Error("zero RestartPolicy marked the module unhealthy")
+	}
+}
+
+func TestModule_RestartPolicy(t *testing.T) {
+	ctx := context.Background()
+	hb := NewHostBuilder(bus.New(), nil, func(...any) {})
+	policy := RestartPolicy{MaxRestarts: 2, Window: time.Second, Backoff: 50 * time.Millisecond}
+	mod, err := LoadWithConfig(ctx, "broken", trapHandleWasm(), hb, LoadConfig{Restart: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+
+	for i := 0; i < 3; i++ {
+		mod.Handle(ctx, &Request{Method: "GET"})
+	}
+	if mod.Healthy() {
+		t.Fatal("module healthy after 3 crashes with MaxRestarts 2")
+	}
+	if _, err := mod.Handle(ctx, &Request{Method: "GET"}); !errors.Is(err, ErrModuleUnhealthy) {
+		t.Errorf("call into unhealthy module = %v, want ErrModuleUnhealthy", err)
+	}
+	if mod.Crashes() != 3 {
+		t.Errorf("crashes = %d, want 3", mod.Crashes())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !mod.Healthy() {
+		t.Error("module still unhealthy after the backoff")
+	}
+}
@@ -0,0 +1,153 @@
+package wasi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ABIVersion is the first byte of every request and response envelope
+// exchanged with a module's handle() export.
+const ABIVersion = 1
+
+var errEnvelope = errors.New("wasi: malformed envelope")
+
+// Request is the HTTP request passed to a module's handle() export.
+//
+// Wire format (little-endian, strings and bytes prefixed by a u32 length):
+//
+//	u8  version
+//	str method
+//	str url            (path and query, e.g. "/m/users?id=1")
+//	u32 header count, then count × (str name, str value)
+//	str body
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// Response is returned by a module's handle() export.
+//
+// handle() returns a pointer to a u32 length followed by that many bytes:
+//
+//	u8  version
+//	u32 status         (0 means 200; otherwise 100-999)
+//	u32 header count, then count × (str name, str value)
+//	str body
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// newRequest captures r as a Request. body is the already-read request body.
+func newRequest(r *http.Request, body []byte) *Request {
+	return &Request{
+		Method: r.Method,
+		URL:    r.URL.RequestURI(),
+		Header: r.Header,
+		Body:   body,
+	}
+}
+
+func (r *Request) encode() []byte {
+	buf := []byte{ABIVersion}
+	buf = appendString(buf, r.Method)
+	buf = appendString(buf, r.URL)
+	buf = appendHeader(buf, r.Header)
+	return appendString(buf, string(r.Body))
+}
+
+func decodeResponse(b []byte) (*Response, error) {
+	d := envelopeReader{buf: b}
+	if d.byte() != ABIVersion {
+		return nil, errEnvelope
+	}
+	resp := &Response{Status: int(d.u32())}
+	resp.Header = d.header()
+	resp.Body = []byte(d.string())
+	if d.err {
+		return nil, errEnvelope
+	}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	// net/http panics on codes outside 100-999.
+	if resp.Status < 100 || resp.Status > 999 {
+		return nil, fmt.Errorf("%w: status %d", errEnvelope, resp.Status)
+	}
+	return resp, nil
+}
+
+func appendU32(buf []byte, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(buf, v)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendU32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func appendHeader(buf []byte, h http.Header) []byte {
+	n := 0
+	for _, values := range h {
+		n += len(values)
+	}
+	buf = appendU32(buf, uint32(n))
+	for name, values := range h {
+		for _, v := range values {
+			buf = appendString(buf, name)
+			buf = appendString(buf, v)
+		}
+	}
+	return buf
+}
+
+// envelopeReader decodes length-prefixed fields; err is set on the first short read.
+type envelopeReader struct {
+	buf []byte
+	err bool
+}
+
+func (d *envelopeReader) take(n uint32) []byte {
+	if d.err || uint64(n) > uint64(len(d.buf)) {
+		d.err = true
+		return nil
+	}
+	out := d.buf[:n]
+	d.buf = d.buf[n:]
+	return out
+}
+
+func (d *envelopeReader) byte() byte {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *envelopeReader) u32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *envelopeReader) string() string {
+	return string(d.take(d.u32()))
+}
+
+func (d *envelopeReader) header() http.Header {
+	n := d.u32()
+	h := make(http.Header)
+	for i := uint32(0); i < n && !d.err; i++ {
+		name := d.string()
+		h.Add(name, d.string())
+	}
+	return h
+}
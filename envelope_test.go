@@ -0,0 +1,116 @@
+package wasi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// encodeResponse is the guest half of the response envelope, including the length prefix.
+func encodeResponse(r *Response) []byte {
+	buf := []byte{ABIVersion}
+	buf = appendU32(buf, uint32(r.Status))
+	buf = appendHeader(buf, r.Header)
+	buf = appendString(buf, string(r.Body))
+	return append(appendU32(nil, uint32(len(buf))), buf...)
+}
+
+// decodeRequest is the guest half of the request envelope.
+func decodeRequest(b []byte) (*Request, bool) {
+	d := envelopeReader{buf: b}
+	if d.byte() != ABIVersion {
+		return nil, false
+	}
+	req := &Request{Method: d.string(), URL: d.string()}
+	req.Header = d.header()
+	req.Body = []byte(d.string())
+	return req, !d.err
+}
+
+func TestEnvelope_RequestRoundTrip(t *testing.T) {
+	r := httptest.NewRequest("POST", "/m/users/42?full=1", strings.NewReader("ignored"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Add("X-Tag", "a")
+	r.Header.Add("X-Tag", "b")
+
+	got, ok := decodeRequest(newRequest(r, []byte(`{"a":1}`)).encode())
+	if !ok {
+		t.Fatal("request envelope did not decode")
+	}
+	if got.Method != "POST" || got.URL != "/m/users/42?full=1" || string(got.Body) != `{"a":1}` {
+		t.Errorf("decoded request = %+v", got)
+	}
+	if got.Header.Get("Content-Type") != "application/json" || len(got.Header.Values("X-Tag")) != 2 {
+		t.Errorf("decoded headers = %v", got.Header)
+	}
+}
+
+func TestEnvelope_DecodeResponse(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "image/png")
+	b := encodeResponse(&Response{Status: 201, Header: h, Body: []byte{0, 1, 2}})
+
+	resp, err := decodeResponse(b[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 201 || resp.Header.Get("Content-Type") != "image/png" || string(resp.Body) != "\x00\x01\x02" {
+		t.Errorf("decoded response = %+v", resp)
+	}
+
+	if resp, _ := decodeResponse(encodeResponse(&Response{})[4:]); resp.Status != http.StatusOK {
+		t.Errorf("status 0 decoded as %d, want 200", resp.Status)
+	}
+
+	if _, err := decodeResponse(b[4 : len(b)-1]); err == nil {
+		t.Error("truncated envelope decoded without error")
+	}
+	for _, status := range []int{5, 99, 1000} {
+		if _, err := decodeResponse(encodeResponse(&Response{Status: status})[4:]); err == nil {
+			t.Errorf("status %d decoded without error", status)
+		}
+	}
+}
+
+func TestWasiServer_DispatchResponse(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Module", "static")
+	f := &wasmFixture{}
+	f.memory(1).dataAt(16, encodeResponse(&Response{Status: http.StatusCreated, Header: h, Body: []byte("created")}))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, i32Const(16)...)
+
+	srv := New()
+	tmp, _ := os.MkdirTemp("", "wasi-dispatch")
+	defer os.RemoveAll(tmp)
+	srv.SetAppRootDir(tmp)
+	if err := srv.swapModule("static", f.bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.handleMiddlewareDispatch(rec, httptest.NewRequest("POST", "/m/static", strings.NewReader("body")))
+
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Module") != "static" || rec.Body.String() != "created" {
+		t.Errorf("response = %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+}
+
+func TestWasiServer_DispatchInvalidStatus(t *testing.T) {
+	f := &wasmFixture{}
+	f.memory(1).dataAt(16, encodeResponse(&Response{Status: 5}))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, i32Const(16)...)
+
+	srv := New().SetAppRootDir(t.TempDir())
+	if err := srv.swapModule("bad", f.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	srv.handleMiddlewareDispatch(rec, httptest.NewRequest("GET", "/m/bad", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status 5 from the guest answered %d, want 502", rec.Code)
+	}
+}
@@ -1,3 +1,12 @@
 module receiver
 
-go 1.23
+go 1.25.2
+
+require github.com/tinywasm/wasi/guest v0.0.0
+
+require (
+	github.com/tinywasm/binary v0.5.15 // indirect
+	github.com/tinywasm/fmt v0.24.5-0.20260623154531-ab6aa6c42456 // indirect
+)
+
+replace github.com/tinywasm/wasi/guest => ../../../guest
@@ -0,0 +1,163 @@
+package wasi
+
+import "encoding/binary"
+
+// wasmFixture assembles small WebAssembly binaries for tests, so guest behaviour
+// can be exercised without a TinyGo toolchain.
+//
+// Imports must be declared before functions: they share the function index space.
+type wasmFixture struct {
+	types   [][]byte
+	imports [][]byte
+	funcs   []uint32
+	codes   [][]byte
+	exports [][]byte
+	data    [][]byte
+	pages   uint32
+	nImport uint32
+}
+
+const (
+	i32 = 0x7f
+	i64 = 0x7e
+)
+
+// memory declares a linear memory of pages and exports it as "memory".
+func (f *wasmFixture) memory(pages uint32) *wasmFixture {
+	f.pages = pages
+	f.exports = append(f.exports, append(wasmName("memory"), 0x02, 0x00))
+	return f
+}
+
+// imp imports env.<name> and returns its function index.
+func (f *wasmFixture) imp(name string, params, results []byte) uint32 {
+	typ := f.typeIdx(params, results)
+	entry := append(wasmName("env"), wasmName(name)...)
+	entry = append(entry, 0x00)
+	entry = append(entry, wasmU32(typ)...)
+	f.imports = append(f.imports, entry)
+	f.nImport++
+	return f.nImport - 1
+}
+
+// fn defines a function and exports it as name unless name is empty.
+// locals lists extra local types; body is the raw instruction stream without the final end.
+func (f *wasmFixture) fn(name string, params, results, locals []byte, body ...byte) uint32 {
+	f.funcs = append(f.funcs, f.typeIdx(params, results))
+	idx := f.nImport + uint32(len(f.funcs)) - 1
+
+	code := wasmU32(uint32(len(locals)))
+	for _, l := range locals {
+		code = append(code, 0x01, l)
+	}
+	code = append(code, body...)
+	code = append(code, 0x0b)
+	f.codes = append(f.codes, append(wasmU32(uint32(len(code))), code...))
+
+	if name != "" {
+		entry := append(wasmName(name), 0x00)
+		f.exports = append(f.exports, append(entry, wasmU32(idx)...))
+	}
+	return idx
+}
+
+// dataAt places b in memory at offset.
+func (f *wasmFixture) dataAt(offset uint32, b []byte) *wasmFixture {
+	seg := []byte{0x00, 0x41}
+	seg = append(seg, wasmI32(int32(offset))...)
+	seg = append(seg, 0x0b)
+	seg = append(seg, wasmU32(uint32(len(b)))...)
+	f.data = append(f.data, append(seg, b...))
+	return f
+}
+
+func (f *wasmFixture) typeIdx(params, results []byte) uint32 {
+	t := []byte{0x60}
+	t = append(t, wasmU32(uint32(len(params)))...)
+	t = append(t, params...)
+	t = append(t, wasmU32(uint32(len(results)))...)
+	t = append(t, results...)
+	for i, existing := range f.types {
+		if string(existing) == string(t) {
+			return uint32(i)
+		}
+	}
+	f.types = append(f.types, t)
+	return uint32(len(f.types) - 1)
+}
+
+func (f *wasmFixture) bytes() []byte {
+	out := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	out = wasmSection(out, 1, f.types)
+	out = wasmSection(out, 2, f.imports)
+	var funcs [][]byte
+	for _, t := range f.funcs {
+		funcs = append(funcs, wasmU32(t))
+	}
+	out = wasmSection(out, 3, funcs)
+	if f.pages > 0 {
+		out = wasmSection(out, 5, [][]byte{append([]byte{0x00}, wasmU32(f.pages)...)})
+	}
+	out = wasmSection(out, 7, f.exports)
+	out = wasmSection(out, 10, f.codes)
+	out = wasmSection(out, 11, f.data)
+	return out
+}
+
+func wasmSection(out []byte, id byte, entries [][]byte) []byte {
+	if len(entries) == 0 {
+		return out
+	}
+	body := wasmU32(uint32(len(entries)))
+	for _, e := range entries {
+		body = append(body, e...)
+	}
+	out = append(out, id)
+	out = append(out, wasmU32(uint32(len(body)))...)
+	return append(out, body...)
+}
+
+func wasmName(s string) []byte {
+	return append(wasmU32(uint32(len(s))), s...)
+}
+
+func wasmU32(v uint32) []byte {
+	return binary.AppendUvarint(nil, uint64(v))
+}
+
+func wasmI32(v int32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// Instruction helpers.
+func i32Const(v int32) []byte { return append([]byte{0x41}, wasmI32(v)...) }
+func i64Const(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append([]byte{0x42}, append(out, b)...)
+		}
+		out = append(out, b|0x80)
+	}
+}
+func localGet(idx uint32) []byte { return append([]byte{0x20}, wasmU32(idx)...) }
+func call(idx uint32) []byte     { return append([]byte{0x10}, wasmU32(idx)...) }
+func drop() []byte               { return []byte{0x1a} }
+
+func ops(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -8,11 +8,11 @@ require (
 	github.com/tetratelabs/wazero v1.11.0
 	github.com/tinywasm/binary v0.5.15
 	github.com/tinywasm/bus v0.0.4
+	github.com/tinywasm/fmt v0.24.5-0.20260623154531-ab6aa6c42456
 	github.com/tinywasm/gobuild v0.0.25
 	nhooyr.io/websocket v1.8.17
 )
 
 require (
-	github.com/tinywasm/fmt v0.24.5-0.20260623154531-ab6aa6c42456 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 )
@@ -0,0 +1,128 @@
+package guest
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// abiVersion matches wasi.ABIVersion.
+const abiVersion = 1
+
+var errEnvelope = errors.New("guest: malformed envelope")
+
+// Request is the HTTP request the server passed to handle().
+type Request struct {
+	Method string
+	URL    string // path and query, e.g. "/m/users?id=1"
+	Header Header
+	Body   []byte
+}
+
+// Response is written back to the HTTP client. A zero Status means 200.
+type Response struct {
+	Status int
+	Header Header
+	Body   []byte
+}
+
+// Header holds HTTP header values by name.
+type Header map[string][]string
+
+// Get returns the first value of name, compared case-insensitively.
+func (h Header) Get(name string) string {
+	for k, v := range h {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (h Header) Set(name, value string) { h[name] = []string{value} }
+func (h Header) Add(name, value string) { h[name] = append(h[name], value) }
+
+func decodeRequest(b []byte) (*Request, error) {
+	d := reader{buf: b}
+	if d.byte() != abiVersion {
+		return nil, errEnvelope
+	}
+	req := &Request{Method: d.string(), URL: d.string()}
+	req.Header = d.header()
+	req.Body = []byte(d.string())
+	if d.err {
+		return nil, errEnvelope
+	}
+	return req, nil
+}
+
+// encode returns the response envelope prefixed by its u32 length, as handle() returns it.
+func (r *Response) encode() []byte {
+	buf := []byte{0, 0, 0, 0, abiVersion}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(r.Status))
+	n := 0
+	for _, values := range r.Header {
+		n += len(values)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n))
+	for name, values := range r.Header {
+		for _, v := range values {
+			buf = appendString(buf, name)
+			buf = appendString(buf, v)
+		}
+	}
+	buf = appendString(buf, string(r.Body))
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)-4))
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// reader decodes length-prefixed fields; err is set on the first short read.
+type reader struct {
+	buf []byte
+	err bool
+}
+
+func (d *reader) take(n uint32) []byte {
+	if d.err || uint64(n) > uint64(len(d.buf)) {
+		d.err = true
+		return nil
+	}
+	out := d.buf[:n]
+	d.buf = d.buf[n:]
+	return out
+}
+
+func (d *reader) byte() byte {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *reader) u32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *reader) string() string {
+	return string(d.take(d.u32()))
+}
+
+func (d *reader) header() Header {
+	n := d.u32()
+	h := make(Header)
+	for i := uint32(0); i < n && !d.err; i++ {
+		name := d.string()
+		h.Add(name, d.string())
+	}
+	return h
+}
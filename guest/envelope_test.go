@@ -0,0 +1,63 @@
+package guest
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// requestEnvelope encodes a request the way the host's Request.encode does.
+func requestEnvelope(method, url string, header [][2]string, body string) []byte {
+	buf := []byte{abiVersion}
+	buf = appendString(buf, method)
+	buf = appendString(buf, url)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(header)))
+	for _, kv := range header {
+		buf = appendString(buf, kv[0])
+		buf = appendString(buf, kv[1])
+	}
+	return appendString(buf, body)
+}
+
+func TestDispatchHandle(t *testing.T) {
+	defer Handle(nil)
+	var got *Request
+	Handle(func(r *Request) *Response {
+		got = r
+		return &Response{Status: 201, Header: Header{"X-Id": {"7"}}, Body: []byte("created")}
+	})
+
+	out := dispatchHandle(requestEnvelope("POST", "/m/users?id=1", [][2]string{{"Content-Type", "text/plain"}}, "alice"))
+
+	if got == nil || got.Method != "POST" || got.URL != "/m/users?id=1" || string(got.Body) != "alice" {
+		t.Fatalf("request = %+v", got)
+	}
+	if got.Header.Get("content-type") != "text/plain" {
+		t.Errorf("header = %v", got.Header)
+	}
+
+	if n := binary.LittleEndian.Uint32(out); int(n) != len(out)-4 {
+		t.Fatalf("length prefix %d, envelope %d bytes", n, len(out)-4)
+	}
+	d := reader{buf: out[4:]}
+	if v, status := d.byte(), d.u32(); v != abiVersion || status != 201 {
+		t.Errorf("version %d status %d", v, status)
+	}
+	if h, body := d.header(), d.string(); !reflect.DeepEqual(h, Header{"X-Id": {"7"}}) || body != "created" || d.err {
+		t.Errorf("header %v body %q err %v", h, body, d.err)
+	}
+}
+
+func TestDispatchHandle_NoResponse(t *testing.T) {
+	if out := dispatchHandle(requestEnvelope("GET", "/", nil, "")); out != nil {
+		t.Errorf("no handler: got %v, want nil", out)
+	}
+	defer Handle(nil)
+	Handle(func(*Request) *Response { return nil })
+	if out := dispatchHandle(requestEnvelope("GET", "/", nil, "")); out != nil {
+		t.Errorf("nil response: got %v, want nil", out)
+	}
+	if _, err := decodeRequest([]byte{abiVersion, 9}); err != errEnvelope {
+		t.Errorf("truncated envelope: got %v", err)
+	}
+}
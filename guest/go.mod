@@ -0,0 +1,7 @@
+module github.com/tinywasm/wasi/guest
+
+go 1.25.2
+
+require github.com/tinywasm/binary v0.5.15
+
+require github.com/tinywasm/fmt v0.24.5-0.20260623154531-ab6aa6c42456 // indirect
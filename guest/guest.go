@@ -0,0 +1,292 @@
+// Package guest is the module side of the tinywasm/wasi host ABI. It wraps the
+// env host functions and owns the exports the server calls (init, drain,
+// health, handle, on_envelope, snapshot, restore, capabilities, malloc), so a
+// module is plain Go:
+//
+//	package main
+//
+//	import "github.com/tinywasm/wasi/guest"
+//
+//	func main() {
+//		guest.OnInit(func() {
+//			guest.Subscribe("events", func(payload []byte) {
+//				guest.Broadcast("events", payload)
+//			})
+//		})
+//		guest.Handle(func(r *guest.Request) *guest.Response {
+//			return &guest.Response{Status: 200, Body: []byte("hello")}
+//		})
+//	}
+//
+// Build with TinyGo: tinygo build -target wasm ./wasm
+package guest
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tinywasm/binary"
+)
+
+// Message is the bus envelope: Topic, Type, correlation ID and Payload.
+type Message = binary.Message
+
+// Status codes returned by host functions; mirrors wasi.Status*.
+const (
+	statusOK       uint32 = 0
+	statusNotFound uint32 = 1
+	statusError    uint32 = 2
+	statusDenied   uint32 = 3
+	statusTimeout  uint32 = 4
+)
+
+var (
+	ErrNotFound = errors.New("guest: not found")
+	ErrDenied   = errors.New("guest: denied by manifest")
+	ErrHost     = errors.New("guest: host call failed")
+	ErrTimeout  = errors.New("guest: request timed out")
+)
+
+func statusErr(status uint32) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusNotFound:
+		return ErrNotFound
+	case statusDenied:
+		return ErrDenied
+	case statusTimeout:
+		return ErrTimeout
+	default:
+		return ErrHost
+	}
+}
+
+var (
+	initFn     func()
+	drainFn    func() uint32
+	healthFn   func() uint32
+	handleFn   func(*Request) *Response
+	snapshotFn func() []byte
+	restoreFn  func([]byte) error
+	handlers   []handler
+)
+
+type handler struct {
+	topic string
+	fn    func(payload []byte)
+	msgFn func(msg *Message)
+}
+
+// OnInit registers fn to run when the host calls init(), after the module is
+// loaded and before it serves traffic. Subscribe from here. The host runs
+// init() on every pooled instance, including ones added later under load, so
+// fn runs more than once per module.
+func OnInit(fn func()) { initFn = fn }
+
+// OnDrain registers fn to report in-flight work during a hot-swap; the host
+// waits until it returns 0. Without it the module is always drained.
+func OnDrain(fn func() uint32) { drainFn = fn }
+
+// OnHealth registers fn to answer the server's readiness check: 0 means ready,
+// anything else is reported on /readyz. Without it the module is always ready.
+func OnHealth(fn func() uint32) { healthFn = fn }
+
+// Handle registers the HTTP handler for /m/<module>. Returning nil yields
+// 204 No Content, or lets the request continue when the module is a middleware.
+func Handle(fn func(*Request) *Response) { handleFn = fn }
+
+// OnSnapshot and OnRestore carry state across a hot-swap: the running module's
+// snapshot is passed to the new module's restore.
+func OnSnapshot(fn func() []byte)     { snapshotFn = fn }
+func OnRestore(fn func([]byte) error) { restoreFn = fn }
+
+// Log writes msg to the server log.
+func Log(msg string) { hostLog(msg) }
+
+// Publish sends payload to every subscriber of topic on the bus.
+func Publish(topic string, payload []byte) error {
+	return statusErr(hostPublish(topic, payload))
+}
+
+// PublishMessage publishes msg on msg.Topic, keeping its Type. The host clears
+// its ID: correlation IDs are assigned by Call only.
+func PublishMessage(msg *Message) error {
+	var encoded []byte
+	if err := binary.Encode(msg, &encoded); err != nil {
+		return err
+	}
+	return statusErr(hostPublishEnvelope(encoded))
+}
+
+// Subscribe calls fn with the payload of every message published to topic and
+// returns the subscription ID for Unsubscribe. A refused subscription (not
+// allowed by the manifest, or no host) returns ErrHost; the host logs the reason.
+// Outside OnInit, messages reach only the instance that subscribed.
+func Subscribe(topic string, fn func(payload []byte)) (uint32, error) {
+	return subscribe(handler{topic: topic, fn: fn})
+}
+
+// SubscribeMessages is Subscribe for callbacks that need the whole Message.
+func SubscribeMessages(topic string, fn func(msg *Message)) (uint32, error) {
+	return subscribe(handler{topic: topic, msgFn: fn})
+}
+
+func subscribe(h handler) (uint32, error) {
+	handlers = append(handlers, h)
+	id := hostSubscribe(h.topic, uint32(len(handlers)-1))
+	if id == 0 {
+		handlers = handlers[:len(handlers)-1]
+		return 0, ErrHost
+	}
+	return id, nil
+}
+
+// Unsubscribe cancels subscription id, or returns ErrNotFound if it is not live.
+func Unsubscribe(id uint32) error {
+	return statusErr(hostUnsubscribe(id))
+}
+
+// Call sends payload as a request on topic and waits up to timeout for a module
+// to Reply. Returns ErrTimeout if none does.
+func Call(topic string, payload []byte, timeout time.Duration) ([]byte, error) {
+	reply, status := hostRequest(topic, payload, uint32(timeout/time.Millisecond))
+	return reply, statusErr(status)
+}
+
+// MessageID returns the correlation ID of the message being handled by a
+// Subscribe callback; 0 if it was published rather than requested.
+// SubscribeMessages callbacks also find it in msg.ID.
+func MessageID() uint32 { return hostMessageID() }
+
+// Reply answers the request with correlation ID id, usually MessageID(). The
+// host refuses IDs of requests not delivered to this module with ErrNotFound.
+func Reply(id uint32, payload []byte) error {
+	return statusErr(hostReply(id, payload))
+}
+
+// Broadcast sends payload to the WebSocket clients of topic.
+func Broadcast(topic string, payload []byte) error {
+	return statusErr(hostWSBroadcast(topic, payload))
+}
+
+// KVGet returns the value of key in the module's store, or ErrNotFound.
+func KVGet(key string) ([]byte, error) {
+	val, status := hostKVGet(key)
+	return val, statusErr(status)
+}
+
+func KVSet(key string, value []byte) error {
+	return statusErr(hostKVSet(key, value))
+}
+
+func KVDelete(key string) error {
+	return statusErr(hostKVDelete(key))
+}
+
+// KVList returns the keys starting with prefix, sorted.
+func KVList(prefix string) ([]string, error) {
+	buf, status := hostKVList(prefix)
+	if status != statusOK {
+		return nil, statusErr(status)
+	}
+	d := reader{buf: buf}
+	keys := make([]string, d.u32())
+	for i := range keys {
+		keys[i] = d.string()
+	}
+	if d.err {
+		return nil, ErrHost
+	}
+	return keys, nil
+}
+
+func runInit() {
+	if initFn != nil {
+		initFn()
+	}
+}
+
+func runDrain() uint32 {
+	if drainFn != nil {
+		return drainFn()
+	}
+	return 0
+}
+
+func runHealth() uint32 {
+	if healthFn != nil {
+		return healthFn()
+	}
+	return 0
+}
+
+// dispatchEnvelope decodes a message and routes it to the callback registered as handler.
+func dispatchEnvelope(encoded []byte, handler uint32) {
+	var msg Message
+	if binary.Decode(encoded, &msg) != nil || int(handler) >= len(handlers) {
+		return
+	}
+	h := handlers[handler]
+	if h.topic != msg.Topic {
+		return
+	}
+	if h.msgFn != nil {
+		h.msgFn(&msg)
+	} else {
+		h.fn(msg.Payload)
+	}
+}
+
+// dispatchHandle decodes a request envelope, runs the handler and returns the
+// length-prefixed response envelope, or nil when there is no response.
+func dispatchHandle(envelope []byte) []byte {
+	if handleFn == nil {
+		return nil
+	}
+	req, err := decodeRequest(envelope)
+	if err != nil {
+		return nil
+	}
+	resp := handleFn(req)
+	if resp == nil {
+		return nil
+	}
+	return resp.encode()
+}
+
+// Bits of the capabilities export. The SDK exports snapshot, restore and
+// health unconditionally; the host only calls those that were registered.
+const (
+	capSnapshot uint32 = 1 << iota
+	capRestore
+	capHealth
+)
+
+func capabilities() uint32 {
+	var caps uint32
+	if snapshotFn != nil {
+		caps |= capSnapshot
+	}
+	if restoreFn != nil {
+		caps |= capRestore
+	}
+	if healthFn != nil {
+		caps |= capHealth
+	}
+	return caps
+}
+
+func runSnapshot() []byte {
+	if snapshotFn != nil {
+		return snapshotFn()
+	}
+	return nil
+}
+
+func runRestore(state []byte) error {
+	if restoreFn != nil {
+		return restoreFn(state)
+	}
+	return nil
+}
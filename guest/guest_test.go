@@ -0,0 +1,56 @@
+package guest
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/tinywasm/binary"
+)
+
+func TestSubscribe_HostErrorDropsHandler(t *testing.T) {
+	if id, err := Subscribe("events", func([]byte) {}); id != 0 || err != ErrHost {
+		t.Errorf("Subscribe without a host = %d, %v; want 0, ErrHost", id, err)
+	}
+	if len(handlers) != 0 {
+		t.Errorf("handlers = %d, want 0", len(handlers))
+	}
+}
+
+func TestDispatchEnvelope_ByHandler(t *testing.T) {
+	defer func() { handlers = nil }()
+	var got []string
+	handlers = []handler{
+		{topic: "a", fn: func(p []byte) { got = append(got, "a:"+string(p)) }},
+		{topic: "b", msgFn: func(m *Message) { got = append(got, "b:"+string(m.Payload)+":"+strconv.Itoa(int(m.ID))) }},
+	}
+	send := func(topic string, id, handler uint32, payload string) {
+		var encoded []byte
+		if err := binary.Encode(&Message{Topic: topic, ID: id, Payload: []byte(payload)}, &encoded); err != nil {
+			t.Fatal(err)
+		}
+		dispatchEnvelope(encoded, handler)
+	}
+
+	send("b", 9, 1, "y")
+	send("a", 0, 0, "x")
+	send("a", 0, 1, "mismatch")
+	send("c", 0, 7, "unknown")
+	dispatchEnvelope([]byte("garbage"), 0)
+
+	if want := []string{"b:y:9", "a:x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dispatched %q, want %q", got, want)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	defer func() { snapshotFn, restoreFn, healthFn = nil, nil, nil }()
+	if got := capabilities(); got != 0 {
+		t.Errorf("capabilities with nothing registered = %b, want 0", got)
+	}
+	OnSnapshot(func() []byte { return nil })
+	OnHealth(func() uint32 { return 0 })
+	if got := capabilities(); got != capSnapshot|capHealth {
+		t.Errorf("capabilities = %b, want snapshot and health", got)
+	}
+}
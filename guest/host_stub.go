@@ -0,0 +1,21 @@
+//go:build !wasm
+
+package guest
+
+// Outside a wasm build there is no host: calls fail with ErrHost and Log
+// prints, so modules still compile for tooling and native unit tests.
+
+func hostLog(msg string) { println(msg) }
+
+func hostPublish(topic string, payload []byte) uint32                      { return statusError }
+func hostPublishEnvelope(msg []byte) uint32                                { return statusError }
+func hostSubscribe(topic string, handlerIdx uint32) uint32                 { return 0 }
+func hostUnsubscribe(id uint32) uint32                                     { return statusError }
+func hostRequest(topic string, payload []byte, ms uint32) ([]byte, uint32) { return nil, statusError }
+func hostReply(id uint32, payload []byte) uint32                           { return statusError }
+func hostMessageID() uint32                                                { return 0 }
+func hostWSBroadcast(topic string, payload []byte) uint32                  { return statusError }
+func hostKVGet(key string) ([]byte, uint32)                                { return nil, statusError }
+func hostKVSet(key string, value []byte) uint32                            { return statusError }
+func hostKVDelete(key string) uint32                                       { return statusError }
+func hostKVList(prefix string) ([]byte, uint32)                            { return nil, statusError }
@@ -0,0 +1,216 @@
+//go:build wasm
+
+package guest
+
+import "unsafe"
+
+//go:wasmimport env publish
+func envPublish(topicPtr, topicLen, payloadPtr, payloadLen uint32) uint32
+
+//go:wasmimport env publish_envelope
+func envPublishEnvelope(msgPtr, msgLen uint32) uint32
+
+//go:wasmimport env subscribe
+func envSubscribe(topicPtr, topicLen, handlerFnIdx uint32) uint32
+
+//go:wasmimport env unsubscribe
+func envUnsubscribe(id uint32) uint32
+
+//go:wasmimport env request
+func envRequest(topicPtr, topicLen, payloadPtr, payloadLen, timeoutMs, outPtrOut, outLenOut uint32) uint32
+
+//go:wasmimport env reply
+func envReply(id, payloadPtr, payloadLen uint32) uint32
+
+//go:wasmimport env message_id
+func envMessageID() uint32
+
+//go:wasmimport env ws_broadcast
+func envWSBroadcast(topicPtr, topicLen, payloadPtr, payloadLen uint32) uint32
+
+//go:wasmimport env log
+func envLog(msgPtr, msgLen uint32)
+
+//go:wasmimport env kv_get
+func envKVGet(keyPtr, keyLen, valPtrOut, valLenOut uint32) uint32
+
+//go:wasmimport env kv_set
+func envKVSet(keyPtr, keyLen, valPtr, valLen uint32) uint32
+
+//go:wasmimport env kv_delete
+func envKVDelete(keyPtr, keyLen uint32) uint32
+
+//go:wasmimport env kv_list
+func envKVList(prefixPtr, prefixLen, outPtrOut, outLenOut uint32) uint32
+
+func hostLog(msg string) {
+	envLog(str(msg))
+}
+
+func hostPublish(topic string, payload []byte) uint32 {
+	tp, tl := str(topic)
+	pp, pl := bytes(payload)
+	return envPublish(tp, tl, pp, pl)
+}
+
+func hostPublishEnvelope(msg []byte) uint32 {
+	return envPublishEnvelope(bytes(msg))
+}
+
+func hostSubscribe(topic string, handlerIdx uint32) uint32 {
+	tp, tl := str(topic)
+	return envSubscribe(tp, tl, handlerIdx)
+}
+
+func hostUnsubscribe(id uint32) uint32 {
+	return envUnsubscribe(id)
+}
+
+func hostRequest(topic string, payload []byte, timeoutMs uint32) ([]byte, uint32) {
+	var ptr, n uint32
+	tp, tl := str(topic)
+	pp, pl := bytes(payload)
+	if status := envRequest(tp, tl, pp, pl, timeoutMs, addr(&ptr), addr(&n)); status != statusOK {
+		return nil, status
+	}
+	return take(ptr, n), statusOK
+}
+
+func hostReply(id uint32, payload []byte) uint32 {
+	pp, pl := bytes(payload)
+	return envReply(id, pp, pl)
+}
+
+func hostMessageID() uint32 {
+	return envMessageID()
+}
+
+func hostWSBroadcast(topic string, payload []byte) uint32 {
+	tp, tl := str(topic)
+	pp, pl := bytes(payload)
+	return envWSBroadcast(tp, tl, pp, pl)
+}
+
+func hostKVGet(key string) ([]byte, uint32) {
+	var ptr, n uint32
+	kp, kl := str(key)
+	if status := envKVGet(kp, kl, addr(&ptr), addr(&n)); status != statusOK {
+		return nil, status
+	}
+	return take(ptr, n), statusOK
+}
+
+func hostKVSet(key string, value []byte) uint32 {
+	kp, kl := str(key)
+	vp, vl := bytes(value)
+	return envKVSet(kp, kl, vp, vl)
+}
+
+func hostKVDelete(key string) uint32 {
+	return envKVDelete(str(key))
+}
+
+func hostKVList(prefix string) ([]byte, uint32) {
+	var ptr, n uint32
+	pp, pl := str(prefix)
+	if status := envKVList(pp, pl, addr(&ptr), addr(&n)); status != statusOK {
+		return nil, status
+	}
+	return take(ptr, n), statusOK
+}
+
+// pinned keeps buffers handed to the host by malloc alive until the export
+// that receives them takes ownership; the host never frees guest memory.
+var pinned = map[uint32][]byte{}
+
+// retained keeps the last handle() or snapshot() result alive while the host reads it.
+var retained []byte
+
+//export malloc
+func malloc(size uint32) uint32 {
+	buf := make([]byte, size+1) // never zero-sized, so the pointer is unique
+	ptr := addr(&buf[0])
+	pinned[ptr] = buf
+	return ptr
+}
+
+// take returns the n bytes the host wrote at ptr and releases the pin.
+func take(ptr, n uint32) []byte {
+	if n == 0 {
+		delete(pinned, ptr)
+		return nil
+	}
+	buf := pinned[ptr]
+	delete(pinned, ptr)
+	if uint32(len(buf)) < n {
+		return nil // not from malloc
+	}
+	return buf[:n]
+}
+
+//export init
+func initExport() {
+	runInit()
+}
+
+//export drain
+func drainExport() uint32 {
+	return runDrain()
+}
+
+//export health
+func healthExport() uint32 {
+	return runHealth()
+}
+
+//export capabilities
+func capabilitiesExport() uint32 {
+	return capabilities()
+}
+
+//export on_envelope
+func onEnvelope(ptr, n, handler uint32) {
+	dispatchEnvelope(take(ptr, n), handler)
+}
+
+//export handle
+func handle(ptr, n uint32) uint32 {
+	retained = dispatchHandle(take(ptr, n))
+	if retained == nil {
+		return 0
+	}
+	return addr(&retained[0])
+}
+
+//export snapshot
+func snapshot() uint64 {
+	retained = runSnapshot()
+	p, n := bytes(retained)
+	return uint64(p)<<32 | uint64(n)
+}
+
+//export restore
+func restore(ptr, n uint32) uint32 {
+	if runRestore(take(ptr, n)) != nil {
+		return 1
+	}
+	return 0
+}
+
+func str(s string) (uint32, uint32) {
+	if len(s) == 0 {
+		return 0, 0
+	}
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func bytes(b []byte) (uint32, uint32) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	return addr(&b[0]), uint32(len(b))
+}
+
+func addr[T any](p *T) uint32 {
+	return uint32(uintptr(unsafe.Pointer(p)))
+}
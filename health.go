@@ -0,0 +1,116 @@
+package wasi
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// healthCheckTimeout bounds each module's health() call during /readyz.
+const healthCheckTimeout = time.Second
+
+// ModuleStatus is one module's entry in the /healthz and /readyz responses.
+type ModuleStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`         // "ok", "unhealthy" (see RestartPolicy) or "failing" (health() non-zero)
+	Code   uint32 `json:"code,omitempty"` // non-zero health() result
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthReport is the JSON body of /healthz and /readyz.
+type HealthReport struct {
+	Status  string         `json:"status"` // "ok", "starting" or "not_ready"
+	Modules []ModuleStatus `json:"modules"`
+}
+
+// Health calls the module's health() export. It returns 0 when the module
+// is ready or does not export health.
+func (m *Module) Health(ctx context.Context) (uint32, error) {
+	if !m.implements("health", func(i *instance) bool { return i.healthFn != nil }) {
+		return 0, nil
+	}
+	var code uint32
+	err := m.call(ctx, func(ctx context.Context, inst *instance) error {
+		if inst.healthFn == nil {
+			return nil
+		}
+		results, err := inst.healthFn.Call(ctx)
+		if err == nil && len(results) > 0 {
+			code = uint32(results[0])
+		}
+		return err
+	})
+	return code, err
+}
+
+// Ready reports whether StartServer has finished compiling and loading the
+// modules present at startup.
+func (s *WasiServer) Ready() bool {
+	return s.ready.Load()
+}
+
+// handleHealthz reports liveness: the server answers while it runs, listing
+// each module's crash status without calling into it.
+func (s *WasiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := HealthReport{Status: "ok", Modules: s.moduleStatuses(r.Context(), false)}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleReadyz reports readiness: 200 once startup loading is done and every
+// module is healthy and its health() returns 0, else 503.
+func (s *WasiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := HealthReport{Status: "ok", Modules: s.moduleStatuses(r.Context(), true)}
+	if !s.Ready() {
+		report.Status = "starting"
+	} else {
+		for _, st := range report.Modules {
+			if st.Status != "ok" {
+				report.Status = "not_ready"
+				break
+			}
+		}
+	}
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, report)
+}
+
+// moduleStatuses reports every loaded module and middleware, sorted by name.
+// With probe, the guest's health() export is called as well.
+func (s *WasiServer) moduleStatuses(ctx context.Context, probe bool) []ModuleStatus {
+	s.mu.RLock()
+	mods := make(map[string]*Module, len(s.modules))
+	for name, mod := range s.modules {
+		mods[name] = mod
+	}
+	s.mu.RUnlock()
+	s.muMw.RLock()
+	for _, mw := range s.middlewares {
+		mods[mw.Module.name] = mw.Module
+	}
+	s.muMw.RUnlock()
+
+	statuses := make([]ModuleStatus, 0, len(mods))
+	for name, mod := range mods {
+		st := ModuleStatus{Name: name, Status: "ok"}
+		switch {
+		case !mod.Healthy():
+			st.Status = "unhealthy"
+		case probe:
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			code, err := mod.Health(ctx)
+			cancel()
+			if err != nil {
+				st.Status, st.Error = "failing", err.Error()
+			} else if code != 0 {
+				st.Status, st.Code = "failing", code
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,152 @@
+package wasi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// healthWasm exports health(), which returns code.
+func healthWasm(code int32) []byte {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("health", nil, []byte{i32}, nil, i32Const(code)...)
+	return f.bytes()
+}
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, HealthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	var report HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	return rec.Code, report
+}
+
+func TestWasiServer_HealthAndReadiness(t *testing.T) {
+	srv := New().SetAppRootDir(t.TempDir())
+	srv.swapModule("users", healthWasm(0))
+	srv.swapModule("plain", staticHandleWasm("ok"))
+
+	if code, report := getHealth(t, srv.handleReadyz); code != http.StatusServiceUnavailable || report.Status != "starting" {
+		t.Errorf("readyz before startup finished = %d %q", code, report.Status)
+	}
+	srv.ready.Store(true)
+	code, report := getHealth(t, srv.handleReadyz)
+	if code != http.StatusOK || report.Status != "ok" || len(report.Modules) != 2 {
+		t.Errorf("readyz = %d %+v", code, report)
+	}
+
+	srv.swapModule("users", healthWasm(3))
+	code, report = getHealth(t, srv.handleReadyz)
+	if code != http.StatusServiceUnavailable || report.Status != "not_ready" {
+		t.Errorf("readyz with failing module = %d %q", code, report.Status)
+	}
+	if st := report.Modules[1]; st.Name != "users" || st.Status != "failing" || st.Code != 3 {
+		t.Errorf("users status = %+v", st)
+	}
+
+	code, report = getHealth(t, srv.handleHealthz)
+	if code != http.StatusOK || report.Modules[1].Status != "ok" {
+		t.Errorf("healthz = %d %+v; liveness should not call health()", code, report)
+	}
+}
+
+func TestModule_HealthWithoutExport(t *testing.T) {
+	ctx := context.Background()
+	mod, err := Load(ctx, "plain", staticHandleWasm("ok"), NewHostBuilder(nil, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+
+	// With the only instance busy, a module without health() still answers.
+	busy, err := mod.pool.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.pool.release(busy)
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if code, err := mod.Health(ctx); code != 0 || err != nil {
+		t.Errorf("Health = %d, %v; want 0, nil without waiting for an instance", code, err)
+	}
+}
+
+func TestWasiServer_SetHealthPaths(t *testing.T) {
+	tmp := t.TempDir()
+	srv := New().SetAppRootDir(tmp).SetOutputDir(tmp).SetListenAddr("127.0.0.1:0").SetHealthPaths("", "/ready")
+	srv.RegisterRoutes(func(mux *http.ServeMux) {
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+	})
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+
+	base := "http://" + srv.Addr().String()
+	if got := getVia(t, http.DefaultClient, base+"/healthz"); got != http.StatusTeapot {
+		t.Errorf("GET /healthz = %d, want the application's own route", got)
+	}
+	if got := getVia(t, http.DefaultClient, base+"/ready"); got != http.StatusOK {
+		t.Errorf("GET /ready = %d", got)
+	}
+	if got := getVia(t, http.DefaultClient, base+"/readyz"); got != http.StatusNotFound {
+		t.Errorf("GET /readyz = %d after moving it", got)
+	}
+}
+
+// capsWasm exports snapshot, restore and health() = 3 like the guest SDK, and
+// capabilities() = caps.
+func capsWasm(caps int32) []byte {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("snapshot", nil, []byte{i32, i32}, nil, ops(i32Const(0), i32Const(0))...)
+	f.fn("restore", []byte{i32, i32}, []byte{i32}, nil, i32Const(0)...)
+	f.fn("health", nil, []byte{i32}, nil, i32Const(3)...)
+	f.fn("capabilities", nil, []byte{i32}, nil, i32Const(caps)...)
+	return f.bytes()
+}
+
+func TestModule_Capabilities(t *testing.T) {
+	ctx := context.Background()
+	load := func(caps int32) *Module {
+		mod, err := Load(ctx, "sdk", capsWasm(caps), NewHostBuilder(nil, nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mod.Close(ctx) })
+		return mod
+	}
+
+	none, all := load(0), load(int32(capSnapshot|capRestore|capHealth))
+	if none.migrates(none) {
+		t.Error("state migrates although snapshot and restore are not implemented")
+	}
+	if !all.migrates(all) {
+		t.Error("state does not migrate although snapshot and restore are implemented")
+	}
+	if code, err := all.Health(ctx); code != 3 || err != nil {
+		t.Errorf("Health = %d, %v; want 3", code, err)
+	}
+
+	// Without OnHealth the module is ready, and no instance is checked out.
+	busy, err := none.pool.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer none.pool.release(busy)
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if code, err := none.Health(ctx); code != 0 || err != nil {
+		t.Errorf("Health without the health capability = %d, %v; want 0, nil", code, err)
+	}
+}
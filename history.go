@@ -0,0 +1,127 @@
+package wasi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrUnknownVersion = errors.New("wasi: unknown module version")
+
+const defaultHistoryLimit = 10
+
+// Version describes one build of a module that was loaded by the server.
+type Version struct {
+	Version  int       `json:"version"`   // 1 for the first load of the module, then increasing
+	Hash     string    `json:"hash"`      // hex sha256 of the wasm bytes
+	LoadedAt time.Time `json:"loaded_at"` // when this version was last swapped in
+	Source   string    `json:"source"`    // file the bytes were read from; empty when loaded from memory
+	Size     int       `json:"size"`      // wasm size in bytes
+	Current  bool      `json:"current"`   // this version is serving the module
+}
+
+type version struct {
+	Version
+	bytes []byte
+}
+
+// moduleHistory is the bounded, oldest-first list of versions of one module.
+type moduleHistory struct {
+	next     int
+	versions []*version
+	current  *version
+}
+
+// SetHistoryLimit sets how many versions of each module are kept for Rollback.
+// The version currently serving is never dropped. Default 10.
+func (s *WasiServer) SetHistoryLimit(n int) *WasiServer {
+	s.historyLimit = n
+	return s
+}
+
+// Versions returns the recorded versions of module name, oldest first.
+func (s *WasiServer) Versions(name string) []Version {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := s.history[name]
+	if h == nil {
+		return nil
+	}
+	out := make([]Version, len(h.versions))
+	for i, v := range h.versions {
+		out[i] = v.Version
+		out[i].Current = v == h.current
+	}
+	return out
+}
+
+// Rollback swaps recorded version n of module name back in. Like an automatic
+// rollback it skips state migration and is not watched for errors.
+func (s *WasiServer) Rollback(name string, n int) error {
+	l := s.swapLock(name)
+	l.Lock()
+	defer l.Unlock()
+	s.mu.RLock()
+	var target *version
+	if h := s.history[name]; h != nil {
+		for _, v := range h.versions {
+			if v.Version.Version == n {
+				target = v
+			}
+		}
+	}
+	s.mu.RUnlock()
+	if target == nil {
+		return ErrUnknownVersion
+	}
+	if err := s.installModuleLocked(name, target.bytes, target.Source, target); err != nil {
+		return err
+	}
+	s.logger("Rolled back:", name, "to version", n)
+	return nil
+}
+
+// recordVersionLocked makes wasmBytes the current version of name, reusing
+// reinstate when a recorded version is swapped back in, and returns the
+// version it replaces. s.mu must be held.
+func (s *WasiServer) recordVersionLocked(name string, wasmBytes []byte, source string, reinstate *version) *version {
+	h := s.history[name]
+	if h == nil {
+		h = &moduleHistory{}
+		s.history[name] = h
+	}
+	prev := h.current
+	if reinstate != nil {
+		reinstate.LoadedAt = time.Now()
+		h.current = reinstate
+		return prev
+	}
+
+	sum := sha256.Sum256(wasmBytes)
+	h.next++
+	h.current = &version{
+		Version: Version{
+			Version:  h.next,
+			Hash:     hex.EncodeToString(sum[:]),
+			LoadedAt: time.Now(),
+			Source:   source,
+			Size:     len(wasmBytes),
+		},
+		bytes: wasmBytes,
+	}
+	h.versions = append(h.versions, h.current)
+
+	limit := s.historyLimit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	for len(h.versions) > limit {
+		i := 0
+		if h.versions[0] == h.current {
+			i = 1
+		}
+		h.versions = append(h.versions[:i], h.versions[i+1:]...)
+	}
+	return prev
+}
@@ -0,0 +1,49 @@
+package wasi
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWasiServer_VersionsAndRollback(t *testing.T) {
+	srv := New().SetAppRootDir(t.TempDir()).SetHistoryLimit(2)
+	if srv.Versions("users") != nil {
+		t.Error("versions recorded before any load")
+	}
+	for _, body := range []string{"v1", "v2", "v3"} {
+		if err := srv.swapModuleFrom("users", staticHandleWasm(body), "users.wasm"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vs := srv.Versions("users")
+	if len(vs) != 2 || vs[0].Version != 2 || vs[1].Version != 3 {
+		t.Fatalf("versions = %+v, want 2 and 3", vs)
+	}
+	if !vs[1].Current || vs[0].Current {
+		t.Error("latest load not marked current")
+	}
+	if vs[0].Hash == vs[1].Hash || len(vs[0].Hash) != 64 || vs[0].Source != "users.wasm" || vs[0].Size == 0 {
+		t.Errorf("version metadata = %+v", vs[0])
+	}
+
+	if err := srv.Rollback("users", 1); err != ErrUnknownVersion {
+		t.Errorf("rollback to dropped version = %v, want ErrUnknownVersion", err)
+	}
+	if err := srv.Rollback("users", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := dispatchBody(srv, httptest.NewRequest("GET", "/m/users", nil)); got != "v2" {
+		t.Errorf("after rollback served by %q, want v2", got)
+	}
+	vs = srv.Versions("users")
+	if len(vs) != 2 || !vs[0].Current || vs[1].Current {
+		t.Errorf("rollback recorded as %+v", vs)
+	}
+
+	srv.swapModule("users", staticHandleWasm("v4"))
+	vs = srv.Versions("users")
+	if len(vs) != 2 || vs[0].Version != 3 || vs[1].Version != 4 {
+		t.Errorf("versions after reload = %+v, want 3 and 4", vs)
+	}
+}
@@ -2,18 +2,78 @@ package wasi
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tinywasm/binary"
 	"github.com/tinywasm/bus"
+	tfmt "github.com/tinywasm/fmt"
 )
 
+// Status codes returned to the guest by host functions.
+const (
+	StatusOK       uint32 = 0
+	StatusNotFound uint32 = 1
+	StatusError    uint32 = 2
+	StatusDenied   uint32 = 3 // refused by the module's manifest
+	StatusTimeout  uint32 = 4 // request got no reply in time
+)
+
+// replyTopicPrefix + correlation ID is the bus topic a request's reply is published on.
+const replyTopicPrefix = "wasi.reply."
+
+// correlationIDs numbers requests across all modules; 0 means "not a request".
+var correlationIDs atomic.Uint32
+
+// pending maps the correlation ID of each request still waiting for its reply
+// to the modules it was delivered to, the only ones allowed to reply.
+var pending = struct {
+	sync.Mutex
+	requests map[uint32]map[*Module]bool
+}{requests: make(map[uint32]map[*Module]bool)}
+
+func openRequest(id uint32) {
+	pending.Lock()
+	pending.requests[id] = make(map[*Module]bool)
+	pending.Unlock()
+}
+
+func closeRequest(id uint32) {
+	pending.Lock()
+	delete(pending.requests, id)
+	pending.Unlock()
+}
+
+// requestDelivered records that the pending request id reached m.
+func requestDelivered(id uint32, m *Module) {
+	pending.Lock()
+	if mods := pending.requests[id]; mods != nil {
+		mods[m] = true
+	}
+	pending.Unlock()
+}
+
+// mayReply reports whether the pending request id was delivered to m.
+func mayReply(id uint32, m *Module) bool {
+	pending.Lock()
+	defer pending.Unlock()
+	return pending.requests[id][m]
+}
+
 type HostBuilder struct {
 	bus         bus.Bus
 	wsBroadcast func(topic string, msg []byte)
 	logger      func(msg ...any)
+	kv          KVStore
+	manifest    *Manifest
+	metrics     *Metrics
 }
 
 func NewHostBuilder(b bus.Bus, wsBroadcast func(topic string, msg []byte), logger func(msg ...any)) *HostBuilder {
@@ -24,88 +84,330 @@ func NewHostBuilder(b bus.Bus, wsBroadcast func(topic string, msg []byte), logge
 	}
 }
 
+// SetKVStore backs the kv_* host functions with store.
+func (h *HostBuilder) SetKVStore(store KVStore) *HostBuilder {
+	h.kv = store
+	return h
+}
+
+// SetManifest restricts the host functions and topics available to the module.
+// A nil manifest grants everything.
+func (h *HostBuilder) SetManifest(mf *Manifest) *HostBuilder {
+	h.manifest = mf
+	return h
+}
+
+// SetMetrics records the module's bus publishes and deliveries in m.
+func (h *HostBuilder) SetMetrics(m *Metrics) *HostBuilder {
+	h.metrics = m
+	return h
+}
+
+// Build returns the env host module with the current ABI, in which publish,
+// subscribe and ws_broadcast return a status or subscription ID.
 func (h *HostBuilder) Build(rt wazero.Runtime) wazero.HostModuleBuilder {
+	return h.build(rt, nil)
+}
+
+// build is Build for a guest importing imports. publish, subscribe and
+// ws_broadcast were void before they returned a status, so a guest that
+// imports them without a result gets the original signature.
+func (h *HostBuilder) build(rt wazero.Runtime, imports []api.FunctionDefinition) wazero.HostModuleBuilder {
+	publish, subscribe, wsBroadcast := any(h.publish), any(h.subscribe), any(h.wsBroadcastFunc)
+	for _, def := range imports {
+		module, name, _ := def.Import()
+		if module != "env" || len(def.ResultTypes()) > 0 {
+			continue
+		}
+		switch name {
+		case "publish":
+			publish = func(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) {
+				h.publish(ctx, m, topicPtr, topicLen, payloadPtr, payloadLen)
+			}
+		case "subscribe":
+			subscribe = func(ctx context.Context, m api.Module, topicPtr, topicLen, handlerFnIdx uint32) {
+				h.subscribe(ctx, m, topicPtr, topicLen, handlerFnIdx)
+			}
+		case "ws_broadcast":
+			wsBroadcast = func(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) {
+				h.wsBroadcastFunc(ctx, m, topicPtr, topicLen, payloadPtr, payloadLen)
+			}
+		}
+	}
 	return rt.NewHostModuleBuilder("env").
-		NewFunctionBuilder().WithFunc(h.publish).Export("publish").
-		NewFunctionBuilder().WithFunc(h.subscribe).Export("subscribe").
-		NewFunctionBuilder().WithFunc(h.wsBroadcastFunc).Export("ws_broadcast").
-		NewFunctionBuilder().WithFunc(h.log).Export("log")
+		NewFunctionBuilder().WithFunc(publish).Export("publish").
+		NewFunctionBuilder().WithFunc(h.publishEnvelope).Export("publish_envelope").
+		NewFunctionBuilder().WithFunc(subscribe).Export("subscribe").
+		NewFunctionBuilder().WithFunc(h.unsubscribe).Export("unsubscribe").
+		NewFunctionBuilder().WithFunc(h.request).Export("request").
+		NewFunctionBuilder().WithFunc(h.reply).Export("reply").
+		NewFunctionBuilder().WithFunc(h.messageID).Export("message_id").
+		NewFunctionBuilder().WithFunc(wsBroadcast).Export("ws_broadcast").
+		NewFunctionBuilder().WithFunc(h.log).Export("log").
+		NewFunctionBuilder().WithFunc(h.kvGet).Export("kv_get").
+		NewFunctionBuilder().WithFunc(h.kvSet).Export("kv_set").
+		NewFunctionBuilder().WithFunc(h.kvDelete).Export("kv_delete").
+		NewFunctionBuilder().WithFunc(h.kvList).Export("kv_list")
 }
 
-func (h *HostBuilder) publish(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) {
+func (h *HostBuilder) publish(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) uint32 {
 	topic := readString(m, topicPtr, topicLen)
+	if !h.permit(ctx, m, "publish", topic) {
+		return StatusDenied
+	}
 	payload := readBytes(m, payloadPtr, payloadLen)
-	h.bus.Publish(topic, binary.Message{Payload: payload})
+	h.bus.Publish(topic, binary.Message{Topic: topic, Type: tfmt.Msg.Event, Payload: payload})
+	h.published(ctx)
+	return StatusOK
 }
 
-func (h *HostBuilder) subscribe(ctx context.Context, m api.Module, topicPtr, topicLen, handlerFnIdx uint32) {
+// publishEnvelope publishes a binary.Message encoded by the guest, keeping its
+// Type. The message is routed by its Topic. Its ID is cleared: correlation IDs
+// are set by request only, so a module cannot pass its message off as another
+// module's request and have the answer sent to that module.
+func (h *HostBuilder) publishEnvelope(ctx context.Context, m api.Module, msgPtr, msgLen uint32) uint32 {
+	var msg binary.Message
+	if err := binary.Decode(readBytes(m, msgPtr, msgLen), &msg); err != nil || msg.Topic == "" {
+		h.logString(ctx, m, "Error: publish_envelope: malformed message")
+		return StatusError
+	}
+	if !h.permit(ctx, m, "publish_envelope", msg.Topic) {
+		return StatusDenied
+	}
+	msg.ID = 0
+	h.bus.Publish(msg.Topic, msg)
+	h.published(ctx)
+	return StatusOK
+}
+
+// subscribe returns the subscription ID, or 0 when the module may not subscribe
+// (the reason is logged). Instances subscribing the same topic and handler share an ID.
+func (h *HostBuilder) subscribe(ctx context.Context, m api.Module, topicPtr, topicLen, handlerFnIdx uint32) uint32 {
 	topic := readString(m, topicPtr, topicLen)
+	if !h.permit(ctx, m, "subscribe", topic) {
+		return 0
+	}
 
-	// Retrieve the Module struct to register cleanup
-	modVal := ctx.Value(moduleKey{})
-	if modVal == nil {
+	// Retrieve the Module struct to track the subscription
+	modInstance := moduleFromContext(ctx)
+	if modInstance == nil {
 		h.logString(ctx, m, "Error: Module not found in context for subscribe")
-		return
+		return 0
 	}
-	modInstance := modVal.(*Module)
 
-	// We need to call on_message(ptr, len) in the module.
-	onMessage := m.ExportedFunction("on_message")
-	if onMessage == nil {
+	// Messages arrive through on_envelope or on_message; both receive
+	// handlerFnIdx so the guest can route to the right callback.
+	if m.ExportedFunction("on_envelope") == nil && m.ExportedFunction("on_message") == nil {
 		h.logString(ctx, m, "Error: on_message not exported")
-		return
+		return 0
 	}
 
-	malloc := m.ExportedFunction("malloc")
-	if malloc == nil {
-		malloc = m.ExportedFunction("alloc")
+	if exportedMalloc(m) == nil {
+		h.logString(ctx, m, "Error: malloc not exported")
+		return 0
 	}
 
-	sub := h.bus.Subscribe(topic, func(msg binary.Message) {
-		// This callback is running in a goroutine managed by bus.
-		// Use background context for callback to avoid using cancelled context from subscribe call.
-		bgCtx := context.Background()
+	// Every pooled instance runs init() and subscribes; the module keeps a single
+	// bus subscription and delivers each message to whichever instance is free.
+	// A subscription made later, e.g. from handle(), is known to the calling
+	// instance only, so its messages go to that instance.
+	pinned, _ := ctx.Value(instanceKey{}).(*instance)
+	if pinned != nil && pinned.mod != m {
+		pinned = nil // the caller is an instance of another module
+	}
+	return modInstance.addSubscription(topic, handlerFnIdx, pinned, func() func() {
+		sub := h.bus.Subscribe(topic, func(msg binary.Message) {
+			// This callback is running in a goroutine managed by bus.
+			// Use background context for callback to avoid using cancelled context from subscribe call.
+			err := modInstance.deliver(context.Background(), pinned, topic, handlerFnIdx, msg)
+			if errors.Is(err, errModuleReplaced) {
+				return // held during a hot-swap; the replacement has its own subscription
+			}
+			h.metrics.add("wasi_bus_delivered_total", 1, modInstance.name)
+			if err != nil {
+				h.metrics.add("wasi_bus_delivery_errors_total", 1, modInstance.name)
+				h.metrics.add("wasi_module_errors_total", 1, modInstance.name, errorKind(err))
+				h.logString(ctx, m, "Error: on_message failed: "+err.Error())
+			}
+		})
+		return sub.Cancel
+	})
+}
 
-		// We need to allocate memory for msg.
-		if malloc == nil {
-			// Cannot allocate
-			return
-		}
+// unsubscribe cancels one of the calling module's subscriptions.
+func (h *HostBuilder) unsubscribe(ctx context.Context, m api.Module, id uint32) uint32 {
+	modInstance := moduleFromContext(ctx)
+	if modInstance == nil {
+		h.logString(ctx, m, "Error: Module not found in context for unsubscribe")
+		return StatusError
+	}
+	if !modInstance.removeSubscription(id) {
+		return StatusNotFound
+	}
+	return StatusOK
+}
 
-		// Allocate memory
-		results, err := malloc.Call(bgCtx, uint64(len(msg.Payload)))
-		if err != nil {
-			return
-		}
-		ptr := uint32(results[0])
+// request publishes payload on topic with a fresh correlation ID and blocks until
+// a module replies or timeoutMs passes. The reply is copied into memory from the
+// guest's malloc; its pointer and length are written to outPtr and outLen.
+func (h *HostBuilder) request(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen, timeoutMs, outPtr, outLen uint32) uint32 {
+	topic := readString(m, topicPtr, topicLen)
+	if !h.permit(ctx, m, "request", topic) {
+		return StatusDenied
+	}
+	id := correlationIDs.Add(1)
+	if id == 0 {
+		id = correlationIDs.Add(1)
+	}
 
-		// Write msg to memory
-		if !m.Memory().Write(ptr, msg.Payload) {
-			return
-		}
+	openRequest(id)
+	defer closeRequest(id)
 
-		// Call on_message
-		_, err = onMessage.Call(bgCtx, uint64(ptr), uint64(len(msg.Payload)))
-		if err != nil {
-			// use logger? But inside callback we might race or need context.
-			// Just verify logger usage in main thread calls.
+	// Listen before publishing so a fast responder cannot be missed.
+	replies := make(chan []byte, 1)
+	sub := h.bus.Subscribe(replyTopic(id), func(msg binary.Message) {
+		select {
+		case replies <- msg.Payload:
+		default:
 		}
 	})
+	defer sub.Cancel()
 
-	modInstance.cleanups = append(modInstance.cleanups, func() {
-		sub.Cancel()
-	})
+	h.bus.Publish(topic, binary.Message{Topic: topic, Type: tfmt.Msg.Request, ID: id, Payload: readBytes(m, payloadPtr, payloadLen)})
+	h.published(ctx)
+
+	timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case payload := <-replies:
+		return writeOut(ctx, m, payload, outPtr, outLen)
+	case <-timer.C:
+		return StatusTimeout
+	case <-ctx.Done():
+		return StatusTimeout
+	}
 }
 
-func (h *HostBuilder) wsBroadcastFunc(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) {
+// reply answers the request with correlation ID id. Only a module the request
+// was delivered to can answer it, and only while the requester waits.
+func (h *HostBuilder) reply(ctx context.Context, m api.Module, id, payloadPtr, payloadLen uint32) uint32 {
+	if !h.permit(ctx, m, "reply", "") {
+		return StatusDenied
+	}
+	if id == 0 || !mayReply(id, moduleFromContext(ctx)) {
+		return StatusNotFound
+	}
+	topic := replyTopic(id)
+	h.bus.Publish(topic, binary.Message{Topic: topic, Type: tfmt.Msg.Response, ID: id, Payload: readBytes(m, payloadPtr, payloadLen)})
+	h.published(ctx)
+	return StatusOK
+}
+
+// messageID returns the correlation ID of the message on_message is handling,
+// or 0 outside on_message and for plain publishes.
+func (h *HostBuilder) messageID(ctx context.Context) uint32 {
+	id, _ := ctx.Value(messageIDKey{}).(uint32)
+	return id
+}
+
+func replyTopic(id uint32) string {
+	return replyTopicPrefix + strconv.FormatUint(uint64(id), 10)
+}
+
+func (h *HostBuilder) wsBroadcastFunc(ctx context.Context, m api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) uint32 {
 	topic := readString(m, topicPtr, topicLen)
+	if !h.permit(ctx, m, "ws_broadcast", topic) {
+		return StatusDenied
+	}
 	payload := readBytes(m, payloadPtr, payloadLen)
 	if h.wsBroadcast != nil {
 		h.wsBroadcast(topic, payload)
 	}
+	return StatusOK
+}
+
+// kvGet looks up key in the caller's namespace. The value is copied into memory
+// from the guest's malloc; its pointer and length are written to valPtrOut and valLenOut.
+func (h *HostBuilder) kvGet(ctx context.Context, m api.Module, keyPtr, keyLen, valPtrOut, valLenOut uint32) uint32 {
+	ns, status := h.kvNamespace(ctx, m, "kv_get")
+	if status != StatusOK {
+		return status
+	}
+	val, found, err := h.kv.Get(ns, readString(m, keyPtr, keyLen))
+	if err != nil {
+		h.logString(ctx, m, "Error: kv_get: "+err.Error())
+		return StatusError
+	}
+	if !found {
+		return StatusNotFound
+	}
+	return writeOut(ctx, m, val, valPtrOut, valLenOut)
+}
+
+func (h *HostBuilder) kvSet(ctx context.Context, m api.Module, keyPtr, keyLen, valPtr, valLen uint32) uint32 {
+	ns, status := h.kvNamespace(ctx, m, "kv_set")
+	if status != StatusOK {
+		return status
+	}
+	if err := h.kv.Set(ns, readString(m, keyPtr, keyLen), readBytes(m, valPtr, valLen)); err != nil {
+		h.logString(ctx, m, "Error: kv_set: "+err.Error())
+		return StatusError
+	}
+	return StatusOK
+}
+
+func (h *HostBuilder) kvDelete(ctx context.Context, m api.Module, keyPtr, keyLen uint32) uint32 {
+	ns, status := h.kvNamespace(ctx, m, "kv_delete")
+	if status != StatusOK {
+		return status
+	}
+	if err := h.kv.Delete(ns, readString(m, keyPtr, keyLen)); err != nil {
+		h.logString(ctx, m, "Error: kv_delete: "+err.Error())
+		return StatusError
+	}
+	return StatusOK
+}
+
+// kvList writes the keys starting with prefix as u32 count followed by
+// count × (u32 length, bytes), like the request envelope's strings.
+func (h *HostBuilder) kvList(ctx context.Context, m api.Module, prefixPtr, prefixLen, outPtr, outLen uint32) uint32 {
+	ns, status := h.kvNamespace(ctx, m, "kv_list")
+	if status != StatusOK {
+		return status
+	}
+	keys, err := h.kv.List(ns, readString(m, prefixPtr, prefixLen))
+	if err != nil {
+		h.logString(ctx, m, "Error: kv_list: "+err.Error())
+		return StatusError
+	}
+	buf := appendU32(nil, uint32(len(keys)))
+	for _, k := range keys {
+		buf = appendString(buf, k)
+	}
+	return writeOut(ctx, m, buf, outPtr, outLen)
+}
+
+// kvNamespace returns the calling module's name, which scopes its keys.
+func (h *HostBuilder) kvNamespace(ctx context.Context, m api.Module, fn string) (string, uint32) {
+	if !h.permit(ctx, m, fn, "") {
+		return "", StatusDenied
+	}
+	if h.kv == nil {
+		h.logString(ctx, m, "Error: no KV store configured")
+		return "", StatusError
+	}
+	mod := moduleFromContext(ctx)
+	if mod == nil {
+		h.logString(ctx, m, "Error: Module not found in context for kv")
+		return "", StatusError
+	}
+	return mod.name, StatusOK
 }
 
 func (h *HostBuilder) log(ctx context.Context, m api.Module, msgPtr, msgLen uint32) {
+	if !h.permit(ctx, m, "log", "") {
+		return
+	}
 	msg := readString(m, msgPtr, msgLen)
 	h.logString(ctx, m, msg)
 }
@@ -118,6 +420,62 @@ func (h *HostBuilder) logString(ctx context.Context, m api.Module, msg string) {
 	}
 }
 
+// permit checks a host function call against the manifest. Topic-scoped
+// functions also check topic. Denied calls are logged.
+func (h *HostBuilder) permit(ctx context.Context, m api.Module, fn, topic string) bool {
+	ok := h.manifest.AllowsFunction(fn)
+	if ok {
+		switch fn {
+		case "publish", "publish_envelope", "request":
+			// Reply topics are written by reply only and read by request
+			// only, so a module cannot forge or read another module's replies.
+			ok = !strings.HasPrefix(topic, replyTopicPrefix) && h.manifest.AllowsPublish(topic)
+		case "subscribe":
+			ok = !strings.HasPrefix(topic, replyTopicPrefix) && h.manifest.AllowsSubscribe(topic)
+		case "ws_broadcast":
+			ok = h.manifest.AllowsWSTopic(topic)
+		}
+	}
+	if !ok {
+		name := "?"
+		if mod := moduleFromContext(ctx); mod != nil {
+			name = mod.name
+		}
+		h.logString(ctx, m, fmt.Sprintf("Denied: %s %s %s", name, fn, topic))
+	}
+	return ok
+}
+
+// published counts a bus publish by the calling module.
+func (h *HostBuilder) published(ctx context.Context) {
+	if mod := moduleFromContext(ctx); mod != nil {
+		h.metrics.add("wasi_bus_published_total", 1, mod.name)
+	}
+}
+
+func moduleFromContext(ctx context.Context) *Module {
+	mod, _ := ctx.Value(moduleKey{}).(*Module)
+	return mod
+}
+
+// writeOut copies data into guest memory obtained from its malloc and stores
+// the resulting pointer and length at ptrOut and lenOut.
+func writeOut(ctx context.Context, m api.Module, data []byte, ptrOut, lenOut uint32) uint32 {
+	var ptr uint32
+	if len(data) > 0 {
+		var err error
+		ptr, err = guestAlloc(ctx, exportedMalloc(m), m.Memory(), data)
+		if err != nil || ptr == 0 {
+			return StatusError
+		}
+	}
+	mem := m.Memory()
+	if !mem.WriteUint32Le(ptrOut, ptr) || !mem.WriteUint32Le(lenOut, uint32(len(data))) {
+		return StatusError
+	}
+	return StatusOK
+}
+
 func readString(m api.Module, offset, length uint32) string {
 	if length == 0 {
 		return ""
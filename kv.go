@@ -0,0 +1,171 @@
+package wasi
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KVStore persists module state for the kv_* host functions.
+// ns is the calling module's name, so modules never see each other's keys.
+type KVStore interface {
+	Get(ns, key string) ([]byte, bool, error)
+	Set(ns, key string, value []byte) error
+	Delete(ns, key string) error
+	List(ns, prefix string) ([]string, error) // keys starting with prefix, sorted
+}
+
+// ErrEmptyKey is returned by the built-in stores for the empty key.
+var ErrEmptyKey = errors.New("wasi: empty key")
+
+// MemoryKV is an in-process KVStore. State survives hot-swaps but not restarts.
+type MemoryKV struct {
+	mu   sync.RWMutex
+	data map[string]map[string][]byte
+}
+
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{data: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryKV) Get(ns, key string) ([]byte, bool, error) {
+	if key == "" {
+		return nil, false, ErrEmptyKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[ns][key]
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]byte(nil), v...), true, nil
+}
+
+func (s *MemoryKV) Set(ns, key string, value []byte) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data[ns] == nil {
+		s.data[ns] = make(map[string][]byte)
+	}
+	s.data[ns][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemoryKV) Delete(ns, key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data[ns], key)
+	return nil
+}
+
+func (s *MemoryKV) List(ns, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for k := range s.data[ns] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// FileKV stores one file per key under dir/<ns>/.
+// Namespaces and keys are base64url-encoded so any non-empty byte string is a
+// safe file name; the empty key would name the namespace directory itself.
+type FileKV struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+func NewFileKV(dir string) *FileKV {
+	return &FileKV{dir: dir}
+}
+
+var kvEncoding = base64.RawURLEncoding
+
+func (s *FileKV) path(ns, key string) string {
+	return filepath.Join(s.dir, kvEncoding.EncodeToString([]byte(ns)), kvEncoding.EncodeToString([]byte(key)))
+}
+
+func (s *FileKV) Get(ns, key string) ([]byte, bool, error) {
+	if key == "" {
+		return nil, false, ErrEmptyKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, err := os.ReadFile(s.path(ns, key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (s *FileKV) Set(ns, key string, value []byte) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(ns, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write then rename so readers never see a partial value.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, value, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileKV) Delete(ns, key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(ns, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileKV) List(ns, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, err := os.ReadDir(filepath.Join(s.dir, kvEncoding.EncodeToString([]byte(ns))))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		k, err := kvEncoding.DecodeString(entry.Name())
+		if err != nil {
+			continue // .tmp leftovers
+		}
+		if strings.HasPrefix(string(k), prefix) {
+			keys = append(keys, string(k))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,98 @@
+package wasi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tinywasm/bus"
+)
+
+func TestKVStore_Implementations(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wasi-kv")
+	defer os.RemoveAll(dir)
+
+	stores := map[string]KVStore{
+		"memory": NewMemoryKV(),
+		"file":   NewFileKV(dir),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			store.Set("users", "session/1", []byte("alice"))
+			store.Set("users", "session/2", []byte("bob"))
+			store.Set("users", "../escape", []byte("x"))
+			store.Set("auth", "session/1", []byte("token"))
+
+			v, ok, err := store.Get("users", "session/1")
+			if err != nil || !ok || string(v) != "alice" {
+				t.Errorf("Get = %q %v %v", v, ok, err)
+			}
+			if v, _, _ := store.Get("auth", "session/1"); string(v) != "token" {
+				t.Errorf("namespaces not isolated: auth got %q", v)
+			}
+
+			keys, _ := store.List("users", "session/")
+			if !reflect.DeepEqual(keys, []string{"session/1", "session/2"}) {
+				t.Errorf("List = %v", keys)
+			}
+
+			store.Delete("users", "session/1")
+			if _, ok, _ := store.Get("users", "session/1"); ok {
+				t.Error("key still present after Delete")
+			}
+			if err := store.Delete("users", "missing"); err != nil {
+				t.Errorf("Delete missing key: %v", err)
+			}
+
+			if err := store.Set("empty", "", []byte("x")); !errors.Is(err, ErrEmptyKey) {
+				t.Errorf("Set empty key: %v, want ErrEmptyKey", err)
+			}
+			if err := store.Set("empty", "k", []byte("v")); err != nil {
+				t.Errorf("Set after empty key: %v", err)
+			}
+		})
+	}
+}
+
+func TestHostBuilder_KV(t *testing.T) {
+	hb := NewHostBuilder(bus.New(), nil, nil).SetKVStore(NewMemoryKV())
+
+	mem := &mockMemory{data: make([]byte, 1024)}
+	copy(mem.data[0:], "count")
+	copy(mem.data[10:], "42")
+	mod := &mockModule{
+		mem: mem,
+		exports: map[string]api.Function{
+			"malloc": &mockFunction{callFn: func(ctx context.Context, params ...uint64) ([]uint64, error) {
+				return []uint64{500}, nil
+			}},
+		},
+	}
+	ctx := context.WithValue(context.Background(), moduleKey{}, &Module{name: "counter"})
+
+	if got := hb.kvGet(ctx, mod, 0, 5, 100, 104); got != StatusNotFound {
+		t.Errorf("kv_get before set = %d, want StatusNotFound", got)
+	}
+	if got := hb.kvSet(ctx, mod, 0, 5, 10, 2); got != StatusOK {
+		t.Fatalf("kv_set = %d", got)
+	}
+	if got := hb.kvGet(ctx, mod, 0, 5, 100, 104); got != StatusOK {
+		t.Fatalf("kv_get = %d", got)
+	}
+	ptr := binary.LittleEndian.Uint32(mem.data[100:])
+	n := binary.LittleEndian.Uint32(mem.data[104:])
+	if string(mem.data[ptr:ptr+n]) != "42" {
+		t.Errorf("kv_get wrote %q", mem.data[ptr:ptr+n])
+	}
+
+	// Another module cannot see the key.
+	other := context.WithValue(context.Background(), moduleKey{}, &Module{name: "other"})
+	if got := hb.kvGet(other, mod, 0, 5, 100, 104); got != StatusNotFound {
+		t.Errorf("kv_get from other module = %d, want StatusNotFound", got)
+	}
+}
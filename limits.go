@@ -0,0 +1,85 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var (
+	// ErrCallTimeout is returned when a call into a module outlives Limits.CallTimeout.
+	ErrCallTimeout = errors.New("wasi: module call exceeded its deadline")
+	// ErrMemoryLimit is returned when a module traps after exhausting Limits.MaxMemoryPages.
+	ErrMemoryLimit = errors.New("wasi: module memory limit exceeded")
+)
+
+// Limits bounds the resources a single module may use.
+// The zero value imposes no limits.
+type Limits struct {
+	MaxMemoryPages     uint32        // 64 KiB pages per instance; 0 keeps wazero's 4 GiB default
+	CallTimeout        time.Duration // deadline for each call into the guest (init, handle, on_message, drain, ...); 0 disables
+	CloseOnContextDone bool          // interrupt running guest code once the call's context is done; implied by CallTimeout
+}
+
+// tighten returns l with every limit of o that is stricter: a lower non-zero
+// memory cap or deadline, and CloseOnContextDone. o can never loosen l.
+func (l Limits) tighten(o Limits) Limits {
+	if o.MaxMemoryPages > 0 && (l.MaxMemoryPages == 0 || o.MaxMemoryPages < l.MaxMemoryPages) {
+		l.MaxMemoryPages = o.MaxMemoryPages
+	}
+	if o.CallTimeout > 0 && (l.CallTimeout == 0 || o.CallTimeout < l.CallTimeout) {
+		l.CallTimeout = o.CallTimeout
+	}
+	l.CloseOnContextDone = l.CloseOnContextDone || o.CloseOnContextDone
+	return l
+}
+
+// runtimeConfig applies l to a wazero RuntimeConfig.
+func (l Limits) runtimeConfig() wazero.RuntimeConfig {
+	cfg := wazero.NewRuntimeConfig()
+	if l.MaxMemoryPages > 0 {
+		cfg = cfg.WithMemoryLimitPages(l.MaxMemoryPages)
+	}
+	// A deadline that cannot interrupt a spinning guest would never fire.
+	return cfg.WithCloseOnContextDone(l.CloseOnContextDone || l.CallTimeout > 0)
+}
+
+// callContext derives the context for one call into the guest.
+func (l Limits) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.CallTimeout > 0 {
+		return context.WithTimeout(ctx, l.CallTimeout)
+	}
+	return ctx, func() {}
+}
+
+// classify maps a failed guest call onto ErrCallTimeout or ErrMemoryLimit when
+// a limit caused it. Other errors are returned unchanged.
+//
+// wazero does not report refused memory.grow, so a trap is attributed to the
+// memory limit when the instance has used all but the last eighth of it.
+func (l Limits) classify(name string, mod api.Module, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == sys.ExitCodeDeadlineExceeded {
+		return fmt.Errorf("%w: %s: %v", ErrCallTimeout, name, err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) && l.CallTimeout > 0 {
+		return fmt.Errorf("%w: %s: %v", ErrCallTimeout, name, err)
+	}
+
+	if l.MaxMemoryPages > 0 && mod != nil && !mod.IsClosed() {
+		limit := uint64(l.MaxMemoryPages) * 65536
+		if mem := mod.Memory(); mem != nil && uint64(mem.Size()) >= limit-limit/8 {
+			return fmt.Errorf("%w: %s: %v", ErrMemoryLimit, name, err)
+		}
+	}
+	return err
+}
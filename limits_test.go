@@ -0,0 +1,68 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tinywasm/bus"
+)
+
+func TestLimits_CallTimeout(t *testing.T) {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	// handle spins forever: loop { br 0 }
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, ops(
+		[]byte{0x03, 0x40, 0x0c, 0x00, 0x0b},
+		i32Const(0),
+	)...)
+
+	ctx := context.Background()
+	limits := Limits{CallTimeout: 50 * time.Millisecond}
+	mod, err := LoadWithConfig(ctx, "spin", f.bytes(), NewHostBuilder(bus.New(), nil, nil), LoadConfig{Limits: limits})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer mod.Close(ctx)
+
+	_, err = mod.Handle(ctx, &Request{Method: "GET", URL: "/m/spin"})
+	if !errors.Is(err, ErrCallTimeout) {
+		t.Fatalf("Handle: got %v, want ErrCallTimeout", err)
+	}
+	if got := statusForError(err); got != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", got)
+	}
+	// The interrupted instance is closed by wazero and must leave the pool.
+	if got := mod.pool.size(); got != 0 {
+		t.Errorf("pool size after timeout = %d, want 0", got)
+	}
+}
+
+func TestLimits_MaxMemoryPages(t *testing.T) {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	// handle grows memory one page at a time and traps when memory.grow fails.
+	grow := ops(i32Const(1), []byte{0x40, 0x00})
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, ops(
+		grow, []byte{0x1a}, // drop
+		grow, i32Const(-1), []byte{0x46}, // i32.eq
+		[]byte{0x04, 0x40, 0x00, 0x0b}, // if { unreachable }
+		i32Const(0),
+	)...)
+
+	srv := New().SetModuleLimits("greedy", Limits{MaxMemoryPages: 2})
+	if err := srv.swapModule("greedy", f.bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.handleMiddlewareDispatch(rec, httptest.NewRequest("GET", "/m/greedy", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 (%s)", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,79 @@
+package wasi
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a listen address as a Unix domain socket path.
+const unixPrefix = "unix:"
+
+// SetListenAddr sets the address StartServer binds, overriding SetPort:
+// "host:port" (port 0 picks a free one; see Addr) or "unix:/path/to.sock".
+func (s *WasiServer) SetListenAddr(addr string) *WasiServer {
+	s.listenAddr = addr
+	return s
+}
+
+// SetListener serves on l, e.g. a socket inherited from a supervisor or a
+// net.UnixListener, instead of opening one. StopServer closes it.
+func (s *WasiServer) SetListener(l net.Listener) *WasiServer {
+	s.listener = l
+	return s
+}
+
+// Addr returns the address the server is bound to, or nil before StartServer.
+func (s *WasiServer) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.addr
+}
+
+// listen returns the listener StartServer serves on.
+func (s *WasiServer) listen() (net.Listener, error) {
+	if s.listener != nil {
+		return s.listener, nil
+	}
+	addr := s.listenAddr
+	if addr == "" {
+		addr = ":" + s.port
+	}
+	return listenOn(addr)
+}
+
+// adminAddr returns the address the admin server binds: AdminConfig.Addr, or
+// AdminConfig.Port on the host the main server is bound to (loopback when
+// that is a Unix socket), so the admin API is never more exposed than the
+// main server.
+func (s *WasiServer) adminAddr(main net.Addr) string {
+	if s.admin.Addr != "" {
+		return s.admin.Addr
+	}
+	host := "127.0.0.1"
+	if tcp, ok := main.(*net.TCPAddr); ok {
+		host = ""
+		if !tcp.IP.IsUnspecified() {
+			host = tcp.IP.String()
+		}
+	}
+	return net.JoinHostPort(host, s.admin.Port)
+}
+
+// listenOn listens on addr, in SetListenAddr form.
+func listenOn(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left behind by an unclean exit would fail the bind; one that
+	// still accepts connections belongs to a live server and is kept.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
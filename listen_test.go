@@ -0,0 +1,79 @@
+package wasi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func getVia(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWasiServer_ListenAddrPortZero(t *testing.T) {
+	tmp := t.TempDir()
+	srv := New().SetAppRootDir(tmp).SetOutputDir(tmp).SetListenAddr("127.0.0.1:0")
+	if srv.Addr() != nil {
+		t.Error("Addr set before StartServer")
+	}
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+
+	addr, ok := srv.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 || !addr.IP.IsLoopback() {
+		t.Fatalf("Addr() = %v, want a loopback address with a real port", srv.Addr())
+	}
+	if got := getVia(t, http.DefaultClient, "http://"+addr.String()+"/healthz"); got != http.StatusOK {
+		t.Errorf("GET /healthz = %d", got)
+	}
+}
+
+func TestWasiServer_UnixSocket(t *testing.T) {
+	tmp := t.TempDir()
+	sock := filepath.Join(tmp, "wasi.sock")
+	srv := New().SetAppRootDir(tmp).SetOutputDir(tmp).SetListenAddr("unix:" + sock)
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+
+	if srv.Addr() == nil || srv.Addr().Network() != "unix" || srv.Addr().String() != sock {
+		t.Fatalf("Addr() = %v, want unix %s", srv.Addr(), sock)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	if got := getVia(t, client, "http://wasi/healthz"); got != http.StatusOK {
+		t.Errorf("GET /healthz over unix socket = %d", got)
+	}
+}
+
+func TestWasiServer_SetListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	srv := New().SetAppRootDir(tmp).SetOutputDir(tmp).SetListener(l)
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+
+	if srv.Addr().String() != l.Addr().String() {
+		t.Errorf("Addr() = %v, want %v", srv.Addr(), l.Addr())
+	}
+	if got := getVia(t, http.DefaultClient, "http://"+l.Addr().String()+"/readyz"); got != http.StatusOK {
+		t.Errorf("GET /readyz = %d", got)
+	}
+}
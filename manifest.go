@@ -0,0 +1,99 @@
+package wasi
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Manifest declares what a module may do. Loaded from a module's module.json,
+// next to wasm/main.go and rule.txt. A module without a manifest may do anything.
+//
+// An omitted list grants everything; an empty list grants nothing.
+// Topic entries are path.Match patterns: "users.*" matches "users.created".
+//
+//	{
+//	  "host_functions": ["publish", "subscribe", "log", "kv_get", "kv_set"],
+//	  "publish":   ["users.*"],
+//	  "subscribe": ["auth.logout", "ws.chat"],
+//	  "ws_topics": ["chat"],
+//	  "limits":    {"max_memory_pages": 32, "call_timeout_ms": 2000, "close_on_context_done": true}
+//	}
+type Manifest struct {
+	HostFunctions []string        `json:"host_functions"`
+	Publish       []string        `json:"publish"`
+	Subscribe     []string        `json:"subscribe"`
+	WSTopics      []string        `json:"ws_topics"`
+	Limits        *ManifestLimits `json:"limits"`
+}
+
+// ManifestLimits is the JSON form of Limits.
+type ManifestLimits struct {
+	MaxMemoryPages     uint32 `json:"max_memory_pages"`
+	CallTimeoutMs      int64  `json:"call_timeout_ms"`
+	CloseOnContextDone bool   `json:"close_on_context_done"`
+}
+
+func (l *ManifestLimits) limits() Limits {
+	return Limits{
+		MaxMemoryPages:     l.MaxMemoryPages,
+		CallTimeout:        time.Duration(l.CallTimeoutMs) * time.Millisecond,
+		CloseOnContextDone: l.CloseOnContextDone,
+	}
+}
+
+// AllowsFunction reports whether the module may call host function name.
+func (mf *Manifest) AllowsFunction(name string) bool {
+	return mf == nil || allows(mf.HostFunctions, name, func(p, v string) bool { return p == v })
+}
+
+// AllowsPublish reports whether the module may publish to topic.
+func (mf *Manifest) AllowsPublish(topic string) bool {
+	return mf == nil || allows(mf.Publish, topic, matchTopic)
+}
+
+// AllowsSubscribe reports whether the module may subscribe to topic.
+func (mf *Manifest) AllowsSubscribe(topic string) bool {
+	return mf == nil || allows(mf.Subscribe, topic, matchTopic)
+}
+
+// AllowsWSTopic reports whether the module may broadcast to WebSocket topic.
+func (mf *Manifest) AllowsWSTopic(topic string) bool {
+	return mf == nil || allows(mf.WSTopics, topic, matchTopic)
+}
+
+func allows(grants []string, v string, match func(pattern, v string) bool) bool {
+	if grants == nil {
+		return true
+	}
+	for _, g := range grants {
+		if match(g, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTopic(pattern, topic string) bool {
+	ok, err := path.Match(pattern, topic)
+	return err == nil && ok
+}
+
+// loadManifestFromSourceDir reads modulesDir/<name>/module.json.
+// Returns (nil, nil) if absent — the module is unrestricted.
+func loadManifestFromSourceDir(modulesDir, name string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(modulesDir, name, "module.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mf := &Manifest{}
+	if err := json.Unmarshal(content, mf); err != nil {
+		return nil, err
+	}
+	return mf, nil
+}
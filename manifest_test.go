@@ -0,0 +1,144 @@
+package wasi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tinywasm/binary"
+	"github.com/tinywasm/bus"
+)
+
+func writeManifest(t *testing.T, root, name, content string) {
+	t.Helper()
+	dir := filepath.Join(root, "modules", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "module.json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifest_Load(t *testing.T) {
+	root := t.TempDir()
+	writeManifest(t, root, "users", `{
+		"host_functions": ["publish", "log"],
+		"publish": ["users.*"],
+		"subscribe": [],
+		"limits": {"max_memory_pages": 4, "call_timeout_ms": 250}
+	}`)
+
+	mf, err := loadManifestFromSourceDir(filepath.Join(root, "modules"), "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mf.AllowsFunction("publish") || mf.AllowsFunction("kv_get") {
+		t.Error("host_functions not applied")
+	}
+	if !mf.AllowsPublish("users.created") || mf.AllowsPublish("auth.login") {
+		t.Error("publish patterns not applied")
+	}
+	if mf.AllowsSubscribe("users.created") {
+		t.Error("empty subscribe list should deny everything")
+	}
+	if !mf.AllowsWSTopic("chat") {
+		t.Error("omitted ws_topics should allow everything")
+	}
+	if l := mf.Limits.limits(); l.MaxMemoryPages != 4 || l.CallTimeout != 250*time.Millisecond {
+		t.Errorf("limits = %+v", l)
+	}
+
+	if mf, err := loadManifestFromSourceDir(filepath.Join(root, "modules"), "missing"); mf != nil || err != nil {
+		t.Errorf("missing manifest = %v, %v; want nil, nil", mf, err)
+	}
+	var none *Manifest
+	if !none.AllowsFunction("kv_set") || !none.AllowsPublish("any") {
+		t.Error("nil manifest should allow everything")
+	}
+}
+
+func TestHostBuilder_ManifestDenies(t *testing.T) {
+	b := bus.New()
+	published := make(chan string, 1)
+	b.Subscribe("auth.login", func(msg binary.Message) { published <- string(msg.Payload) })
+
+	var logged []string
+	hb := NewHostBuilder(b, nil, func(msg ...any) {
+		logged = append(logged, msg[1].(string))
+	}).SetKVStore(NewMemoryKV()).SetManifest(&Manifest{
+		HostFunctions: []string{"publish"},
+		Publish:       []string{"users.*"},
+	})
+
+	mem := &mockMemory{data: make([]byte, 1024)}
+	copy(mem.data[0:], "auth.login")
+	copy(mem.data[20:], "x")
+	mod := &mockModule{mem: mem, exports: make(map[string]api.Function)}
+	ctx := context.WithValue(context.Background(), moduleKey{}, &Module{name: "users"})
+
+	if got := hb.publish(ctx, mod, 0, 10, 20, 1); got != StatusDenied {
+		t.Errorf("publish to unlisted topic = %d, want StatusDenied", got)
+	}
+	if got := hb.kvSet(ctx, mod, 20, 1, 20, 1); got != StatusDenied {
+		t.Errorf("kv_set not in host_functions = %d, want StatusDenied", got)
+	}
+
+	select {
+	case <-published:
+		t.Error("denied publish reached the bus")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(logged) != 2 || !strings.Contains(logged[0], "Denied: users publish auth.login") {
+		t.Errorf("denials logged as %q", logged)
+	}
+}
+
+func TestWasiServer_SwapModule_BadManifestKeepsOld(t *testing.T) {
+	root := t.TempDir()
+	srv := New().SetAppRootDir(root)
+	if err := srv.swapModule("counter", snapshotWasm("v1")); err != nil {
+		t.Fatal(err)
+	}
+	old := srv.loadedModule("counter", false)
+
+	writeManifest(t, root, "counter", `{"publish": [`)
+	if err := srv.swapModule("counter", snapshotWasm("v2")); err == nil {
+		t.Fatal("swap succeeded with an invalid manifest")
+	}
+	if srv.loadedModule("counter", false) != old {
+		t.Error("old module replaced after manifest error")
+	}
+}
+
+func TestWasiServer_ManifestLimits(t *testing.T) {
+	root := t.TempDir()
+	writeManifest(t, root, "users", `{"limits": {"max_memory_pages": 8}}`)
+	mf, _ := loadManifestFromSourceDir(filepath.Join(root, "modules"), "users")
+
+	srv := New().SetLimits(Limits{MaxMemoryPages: 64})
+	if got := srv.loadConfig("users", mf).Limits.MaxMemoryPages; got != 8 {
+		t.Errorf("manifest limits ignored: got %d pages", got)
+	}
+	srv.SetModuleLimits("users", Limits{MaxMemoryPages: 4})
+	if got := srv.loadConfig("users", mf).Limits.MaxMemoryPages; got != 4 {
+		t.Errorf("manifest loosened SetModuleLimits: got %d pages", got)
+	}
+
+	// A manifest can only tighten the operator's limits, field by field.
+	writeManifest(t, root, "loose", `{"limits": {"max_memory_pages": 1024, "call_timeout_ms": 50}}`)
+	mf, _ = loadManifestFromSourceDir(filepath.Join(root, "modules"), "loose")
+	srv = New().SetLimits(Limits{MaxMemoryPages: 64, CallTimeout: time.Second})
+	if got := srv.loadConfig("loose", mf).Limits; got.MaxMemoryPages != 64 || got.CallTimeout != 50*time.Millisecond {
+		t.Errorf("limits = %+v, want 64 pages and 50ms", got)
+	}
+	writeManifest(t, root, "empty", `{"limits": {}}`)
+	mf, _ = loadManifestFromSourceDir(filepath.Join(root, "modules"), "empty")
+	if got := srv.loadConfig("empty", mf).Limits; got.MaxMemoryPages != 64 || got.CallTimeout != time.Second {
+		t.Errorf("empty manifest limits dropped the operator's: %+v", got)
+	}
+}
@@ -0,0 +1,215 @@
+package wasi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics counts server activity and renders it in the Prometheus text format.
+// All methods are safe on a nil *Metrics, which records nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*family
+	gauges   map[string]*gaugeFunc
+}
+
+type family struct {
+	help   string
+	kind   string // "counter" or "histogram"
+	labels []string
+	series map[string]*series // by rendered label set
+}
+
+type series struct {
+	value   float64  // counter
+	buckets []uint64 // histogram, per bucket; rendered cumulative
+	sum     float64
+	count   uint64
+}
+
+type gaugeFunc struct {
+	help string
+	fn   func() float64
+}
+
+// durationBuckets are the histogram bounds, in seconds, for every duration metric.
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewMetrics creates the metric families recorded by WasiServer, HostBuilder and wsHub.
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*family), gauges: make(map[string]*gaugeFunc)}
+	m.define("wasi_requests_total", "counter", "Requests dispatched to /m/{module}, by response status.", "module", "code")
+	m.define("wasi_request_duration_seconds", "histogram", "Time to serve /m/{module} requests, middlewares included.", "module")
+	m.define("wasi_module_errors_total", "counter", "Failed guest calls, by kind: trap, timeout, memory, unhealthy or error.", "module", "kind")
+	m.define("wasi_swaps_total", "counter", "Module loads and hot-swaps, by result: ok or error.", "module", "result")
+	m.define("wasi_drain_duration_seconds", "histogram", "Time spent draining a module before it is closed.", "module")
+	m.define("wasi_bus_published_total", "counter", "Bus messages published by a module.", "module")
+	m.define("wasi_bus_delivered_total", "counter", "Bus messages delivered to a module's on_message or on_envelope.", "module")
+	m.define("wasi_bus_delivery_errors_total", "counter", "Bus deliveries whose handler failed.", "module")
+	m.define("wasi_ws_dropped_total", "counter", "WebSocket frames dropped because a client's send buffer was full.", "topic")
+	return m
+}
+
+func (m *Metrics) define(name, kind, help string, labels ...string) {
+	m.families[name] = &family{help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// Gauge registers fn, sampled on every scrape, as the gauge name.
+func (m *Metrics) Gauge(name, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.gauges[name] = &gaugeFunc{help: help, fn: fn}
+	m.mu.Unlock()
+}
+
+// add increases counter name by v for the given label values.
+func (m *Metrics) add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.series(name, labels).value += v
+	m.mu.Unlock()
+}
+
+// observe records v in histogram name for the given label values.
+func (m *Metrics) observe(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	s := m.series(name, labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(durationBuckets))
+	}
+	for i, le := range durationBuckets {
+		if v <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	m.mu.Unlock()
+}
+
+// series returns the series of family name for labels. m.mu must be held.
+func (m *Metrics) series(name string, labels []string) *series {
+	f := m.families[name]
+	key := renderLabels(f.labels, labels)
+	s := f.series[key]
+	if s == nil {
+		s = &series{}
+		f.series[key] = s
+	}
+	return s
+}
+
+// errorKind labels a failed guest call for wasi_module_errors_total.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrCallTimeout):
+		return "timeout"
+	case errors.Is(err, ErrMemoryLimit):
+		return "memory"
+	case errors.Is(err, ErrModuleUnhealthy):
+		return "unhealthy"
+	case isTrap(err):
+		return "trap"
+	}
+	return "error"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(name + `="` + labelEscaper.Replace(v) + `"`)
+	}
+	return b.String()
+}
+
+// Write renders every metric in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	gauges := make(map[string]*gaugeFunc, len(m.gauges))
+	for name, g := range m.gauges {
+		gauges[name] = g
+	}
+	m.mu.Unlock()
+	// Sample gauges without m.mu: they may take other locks that are held
+	// while counters are recorded.
+	sampled := make(map[string]float64, len(gauges))
+	for name, g := range gauges {
+		sampled[name] = g.fn()
+	}
+
+	// Render under m.mu but write after, so a slow client does not block
+	// the calls recording metrics.
+	var bw bytes.Buffer
+	m.mu.Lock()
+	for _, name := range sortedKeys(m.families) {
+		f := m.families[name]
+		bw.WriteString("# HELP " + name + " " + f.help + "\n# TYPE " + name + " " + f.kind + "\n")
+		for _, key := range sortedKeys(f.series) {
+			s := f.series[key]
+			if f.kind == "counter" {
+				bw.WriteString(name + "{" + key + "} " + formatFloat(s.value) + "\n")
+				continue
+			}
+			var cum uint64
+			for i, le := range durationBuckets {
+				cum += s.buckets[i]
+				bw.WriteString(name + "_bucket{" + key + `,le="` + formatFloat(le) + `"} ` + strconv.FormatUint(cum, 10) + "\n")
+			}
+			bw.WriteString(name + "_bucket{" + key + `,le="+Inf"} ` + strconv.FormatUint(s.count, 10) + "\n")
+			bw.WriteString(name + "_sum{" + key + "} " + formatFloat(s.sum) + "\n")
+			bw.WriteString(name + "_count{" + key + "} " + strconv.FormatUint(s.count, 10) + "\n")
+		}
+	}
+	m.mu.Unlock()
+	for _, name := range sortedKeys(gauges) {
+		bw.WriteString("# HELP " + name + " " + gauges[name].help + "\n# TYPE " + name + " gauge\n")
+		bw.WriteString(name + " " + formatFloat(sampled[name]) + "\n")
+	}
+	_, err := w.Write(bw.Bytes())
+	return err
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
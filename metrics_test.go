@@ -0,0 +1,101 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_Write(t *testing.T) {
+	m := NewMetrics()
+	m.add("wasi_swaps_total", 1, "users", "ok")
+	m.add("wasi_swaps_total", 1, "users", "ok")
+	m.add("wasi_ws_dropped_total", 1, `a"b`)
+	m.observe("wasi_drain_duration_seconds", 0.02, "users")
+	m.Gauge("wasi_test_gauge", "A gauge.", func() float64 { return 3 })
+
+	var b strings.Builder
+	if err := m.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE wasi_swaps_total counter\n",
+		`wasi_swaps_total{module="users",result="ok"} 2` + "\n",
+		`wasi_ws_dropped_total{topic="a\"b"} 1` + "\n",
+		`wasi_drain_duration_seconds_bucket{module="users",le="0.01"} 0` + "\n",
+		`wasi_drain_duration_seconds_bucket{module="users",le="0.025"} 1` + "\n",
+		`wasi_drain_duration_seconds_bucket{module="users",le="+Inf"} 1` + "\n",
+		`wasi_drain_duration_seconds_count{module="users"} 1` + "\n",
+		"# TYPE wasi_test_gauge gauge\nwasi_test_gauge 3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	var none *Metrics
+	none.add("wasi_swaps_total", 1, "users", "ok")
+}
+
+func TestErrorKind(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("handle: %w", ErrCallTimeout), "timeout"},
+		{ErrMemoryLimit, "memory"},
+		{ErrModuleUnhealthy, "unhealthy"},
+		{errors.New("wasm error: unreachable"), "trap"},
+		{errors.New("malloc returned 0"), "error"},
+	}
+	for _, c := range cases {
+		if got := errorKind(c.err); got != c.want {
+			t.Errorf("errorKind(%v) = %s, want %s", c.err, got, c.want)
+		}
+	}
+}
+
+func TestWasiServer_Metrics(t *testing.T) {
+	srv := New().SetAppRootDir(t.TempDir())
+	srv.swapModule("users", staticHandleWasm("v1"))
+	srv.swapModule("broken", trapHandleWasm())
+	// A pass-through middleware, so unknown modules still reach the pipeline.
+	pass := &wasmFixture{}
+	pass.memory(1)
+	pass.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	pass.fn("handle", []byte{i32, i32}, []byte{i32}, nil, i32Const(0)...)
+	mw, err := Load(context.Background(), "pass", pass.bytes(), NewHostBuilder(srv.bus, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mw.Close(context.Background())
+	srv.middlewares = append(srv.middlewares, &MiddlewareModule{Module: mw, Rule: Rule{All: true}})
+
+	dispatchBody(srv, httptest.NewRequest("GET", "/m/users", nil))
+	dispatchBody(srv, httptest.NewRequest("GET", "/m/broken", nil))
+	dispatchBody(srv, httptest.NewRequest("GET", "/m/nope", nil))
+
+	rec := httptest.NewRecorder()
+	srv.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, want := range []string{
+		`wasi_requests_total{module="users",code="200"} 1`,
+		`wasi_requests_total{module="broken",code="500"} 1`,
+		`wasi_module_errors_total{module="broken",kind="trap"} 1`,
+		`wasi_swaps_total{module="users",result="ok"} 1`,
+		`wasi_request_duration_seconds_count{module="users"} 1`,
+		"wasi_modules_loaded 3",
+		"wasi_ws_clients 0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `module="nope"`) {
+		t.Error("request for an unknown module was counted")
+	}
+}
@@ -9,9 +9,9 @@ import (
 // Rule describes which HTTP routes a middleware module applies to.
 // Loaded from a module's rule.txt at startup.
 type Rule struct {
-	All    bool
-	Only   []string // apply only to these route names
-	Except []string // apply to all except these route names
+	All    bool     `json:"all"`
+	Only   []string `json:"only,omitempty"`   // apply only to these route names
+	Except []string `json:"except,omitempty"` // apply to all except these route names
 }
 
 // parseRule parses the content of rule.txt.
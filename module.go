@@ -2,29 +2,128 @@ package wasi
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tinywasm/binary"
 )
 
 type Module struct {
 	name     string
 	runtime  wazero.Runtime
-	mod      api.Module
-	active   atomic.Int32
-	drainFn  api.Function // exported drain() uint32
-	initFn   api.Function // exported init()
-	handleFn api.Function // optional: exported handle(req_ptr, req_len uint32) uint32
-	cleanups []func()
+	compiled wazero.CompiledModule
+	pool     *instancePool
+	limits   Limits
+	inited   atomic.Bool
+	active   atomic.Int32  // calls in flight (handle, on_message, init, ...)
+	calls    atomic.Uint64 // guest calls made, for error-rate monitoring
+	failures atomic.Uint64 // calls that returned an error (trap, timeout, memory limit)
+	crashes  atomic.Uint64 // instances closed after a trap
+	restarts restartTracker
+	logger   func(msg ...any)
+	mu       sync.Mutex // guards subs, subIDs, nextSubID and offBus
+
+	// While a hot-swap migrates state out of the module, new calls wait on
+	// held; once the swap completes they fail with errModuleReplaced and
+	// Handle retries them on next.
+	holdMu sync.Mutex
+	held   chan struct{}
+	next   *Module
+
+	// subs holds the module's live bus subscriptions by ID. Every pooled
+	// instance runs init() and subscribes, but the module only needs one bus
+	// subscription per topic and handler; subIDs dedupes them, and keeps the
+	// IDs of cancelled ones so instances created later do not renew them.
+	subs      map[uint32]*liveSub
+	subIDs    map[subKey]uint32
+	nextSubID uint32
+	offBus    bool // subscriptions are recorded but not made; see holdSubscriptions
+}
+
+// Subscription is a live bus subscription held by a module.
+type Subscription struct {
+	ID      uint32 `json:"id"`
+	Topic   string `json:"topic"`
+	Handler uint32 `json:"handler"` // guest handler index passed to subscribe
+}
+
+type liveSub struct {
+	Subscription
+	inst      *instance // set when made outside init(), see addSubscription
+	subscribe func() func()
+	cancel    func() // nil while the module is off the bus
+}
+
+func (s *liveSub) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+type subKey struct {
+	topic   string
+	handler uint32
 }
 
 type moduleKey struct{}
 
+// instanceKey carries the instance serving a call made through the pool.
+// init() and restore() run without it.
+type instanceKey struct{}
+
+// holdKey marks the context of the hot-swap holding a module, whose own
+// calls pass the hold.
+type holdKey struct{}
+
+// errModuleReplaced fails calls held during a hot-swap that replaced the module.
+var errModuleReplaced = errors.New("wasi: module replaced")
+
+// ErrDrainTimeout is returned by Drain when the module is still busy at the timeout.
+var ErrDrainTimeout = errors.New("wasi: drain timed out")
+
+// drainPollInterval is how often Drain rechecks calls in flight once drain() reports 0.
+const drainPollInterval = 5 * time.Millisecond
+
+// messageIDKey carries the correlation ID of the message being delivered.
+type messageIDKey struct{}
+
+// LoadConfig tunes how a module is instantiated.
+type LoadConfig struct {
+	PoolMin int // instances created up front; default 1
+	PoolMax int // upper bound on concurrent instances; default PoolMin
+	Limits  Limits
+	Cache   *CompilationCache // optional; shared across runtimes
+	Restart RestartPolicy
+	Logger  func(msg ...any) // receives crash reports; optional
+}
+
+// Load compiles wasmBytes and instantiates a module backed by a single instance.
 func Load(ctx context.Context, name string, wasmBytes []byte, hb *HostBuilder) (*Module, error) {
-	r := wazero.NewRuntime(ctx)
+	return LoadWithConfig(ctx, name, wasmBytes, hb, LoadConfig{})
+}
+
+// LoadWithConfig compiles wasmBytes once and instantiates cfg.PoolMin instances of it.
+// Further instances are created on demand, up to cfg.PoolMax.
+func LoadWithConfig(ctx context.Context, name string, wasmBytes []byte, hb *HostBuilder, cfg LoadConfig) (*Module, error) {
+	if cfg.PoolMin < 1 {
+		cfg.PoolMin = 1
+	}
+	if cfg.PoolMax < cfg.PoolMin {
+		cfg.PoolMax = cfg.PoolMin
+	}
+
+	rtCfg := cfg.Limits.runtimeConfig()
+	if cfg.Cache != nil {
+		rtCfg = rtCfg.WithCompilationCache(cfg.Cache.cache)
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, rtCfg)
 
 	// Enable WASI
 	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
@@ -32,100 +131,589 @@ func Load(ctx context.Context, name string, wasmBytes []byte, hb *HostBuilder) (
 		return nil, err
 	}
 
-	// Build host module
-	if _, err := hb.Build(r).Instantiate(ctx); err != nil {
+	// Compile module (handles WAT or WASM)
+	var compiled wazero.CompiledModule
+	var err error
+	if cfg.Cache != nil {
+		compiled, err = cfg.Cache.compile(ctx, r, wasmBytes)
+	} else {
+		compiled, err = r.CompileModule(ctx, wasmBytes)
+	}
+	if err != nil {
 		r.Close(ctx)
 		return nil, err
 	}
 
-	// Compile module (handles WAT or WASM)
-	compiled, err := r.CompileModule(ctx, wasmBytes)
-	if err != nil {
+	// Build host module, matching the signatures the module imports
+	if _, err := hb.build(r, compiled.ImportedFunctions()).Instantiate(ctx); err != nil {
 		r.Close(ctx)
 		return nil, err
 	}
 
 	m := &Module{
-		name:    name,
-		runtime: r,
+		name:     name,
+		runtime:  r,
+		compiled: compiled,
+		limits:   cfg.Limits,
+		restarts: restartTracker{policy: cfg.Restart},
+		logger:   cfg.Logger,
+		subs:     make(map[uint32]*liveSub),
+		subIDs:   make(map[subKey]uint32),
 	}
+	m.pool = newInstancePool(cfg.PoolMax, m.instantiate)
 
+	if err := m.pool.fill(ctx, cfg.PoolMin); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// instantiate creates a fresh anonymous instance of the compiled module.
+// Instances created after Init run init() before they are handed out, so
+// init() runs again whenever the pool grows.
+func (m *Module) instantiate(ctx context.Context) (*instance, error) {
 	// Pass m in context so host functions can access it
-	ctxWithModule := context.WithValue(ctx, moduleKey{}, m)
+	ctx = m.withModule(ctx)
 
-	mod, err := r.InstantiateModule(ctxWithModule, compiled, wazero.NewModuleConfig())
+	// Anonymous instances let the same CompiledModule be instantiated many times.
+	mod, err := m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().WithName(""))
 	if err != nil {
-		r.Close(ctx)
 		return nil, err
 	}
-	m.mod = mod
-
-	m.drainFn = mod.ExportedFunction("drain")
-	m.initFn = mod.ExportedFunction("init")
-	m.handleFn = mod.ExportedFunction("handle")
+	inst := newInstance(mod)
+	if err := inst.applyCapabilities(ctx); err != nil {
+		mod.Close(ctx)
+		return nil, err
+	}
 
-	return m, nil
+	if m.inited.Load() {
+		if err := m.initInstance(ctx, inst); err != nil {
+			mod.Close(ctx)
+			return nil, err
+		}
+	}
+	return inst, nil
 }
 
-func (m *Module) Drain(ctx context.Context, timeout time.Duration) error {
-	if m.drainFn == nil {
+// initInstance calls init() on inst, which the caller holds exclusively.
+func (m *Module) initInstance(ctx context.Context, inst *instance) error {
+	if inst.initFn == nil {
 		return nil
 	}
+	m.active.Add(1)
+	defer m.active.Add(-1)
+	return m.invoke(ctx, inst, func(ctx context.Context, inst *instance) error {
+		_, err := inst.initFn.Call(ctx)
+		return err
+	})
+}
 
-	start := time.Now()
+// withModule returns ctx carrying m so host functions can reach the calling Module.
+func (m *Module) withModule(ctx context.Context) context.Context {
+	return context.WithValue(ctx, moduleKey{}, m)
+}
+
+// call runs fn with an exclusive instance from the pool, within the module's Limits.
+// Instances closed by wazero (deadline, proc_exit) or after a trap are dropped
+// from the pool.
+func (m *Module) call(ctx context.Context, fn func(ctx context.Context, inst *instance) error) error {
+	return m.callOn(ctx, nil, fn)
+}
+
+// callOn is call on pinned, waiting for it to be free, or on any instance if
+// pinned is nil. Subscriptions pinned to an instance that has left the pool
+// are cancelled.
+func (m *Module) callOn(ctx context.Context, pinned *instance, fn func(ctx context.Context, inst *instance) error) error {
+	if err := m.enter(ctx); err != nil {
+		return err
+	}
+	defer m.active.Add(-1)
+	if !m.Healthy() {
+		m.calls.Add(1)
+		m.failures.Add(1)
+		return fmt.Errorf("%w: %s", ErrModuleUnhealthy, m.name)
+	}
+	var inst *instance
+	var err error
+	if pinned != nil {
+		inst, err = m.pool.acquireInstance(ctx, pinned)
+	} else {
+		inst, err = m.pool.acquire(m.withModule(ctx))
+	}
+	if errors.Is(err, errInstanceGone) {
+		m.dropSubscriptions(pinned)
+	}
+	if err != nil {
+		return err
+	}
+	err = m.invoke(context.WithValue(ctx, instanceKey{}, inst), inst, fn)
+	if inst.mod.IsClosed() {
+		m.pool.discard(inst)
+		m.dropSubscriptions(inst)
+	} else {
+		m.pool.release(inst)
+	}
+	return err
+}
+
+// enter counts a call in flight. While the module is held it waits for the
+// hold to end, uncounted so Drain can finish, unless ctx is the holder's.
+func (m *Module) enter(ctx context.Context) error {
 	for {
-		results, err := m.drainFn.Call(ctx)
-		if err != nil {
-			// If error, maybe we should stop draining?
-			return err
+		m.active.Add(1)
+		m.holdMu.Lock()
+		held, next := m.held, m.next
+		m.holdMu.Unlock()
+		switch {
+		case next != nil:
+			m.active.Add(-1)
+			return errModuleReplaced
+		case held == nil || ctx.Value(holdKey{}) == m:
+			return nil
 		}
-		// Assuming drain returns uint32 (ms)
-		if len(results) == 0 {
-			break
-		}
-		ms := uint32(results[0])
-		if ms == 0 {
-			break
+		m.active.Add(-1)
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
+}
+
+// hold makes new calls wait until release. Calls made with the returned
+// context, which belong to the caller's hot-swap, are not held.
+func (m *Module) hold(ctx context.Context) context.Context {
+	m.holdMu.Lock()
+	m.held = make(chan struct{})
+	m.holdMu.Unlock()
+	return context.WithValue(ctx, holdKey{}, m)
+}
 
-		if time.Since(start) > timeout {
-			// Timeout
-			break
+// release ends a hold. With next, the module has been replaced: held and
+// later calls fail with errModuleReplaced and Handle retries them on next.
+func (m *Module) release(next *Module) {
+	m.holdMu.Lock()
+	m.next = next
+	if m.held != nil {
+		close(m.held)
+		m.held = nil
+	}
+	m.holdMu.Unlock()
+}
+
+// invoke runs fn on inst, which the caller has checked out, within the
+// module's Limits. A trap closes inst; the caller drops it from the pool.
+func (m *Module) invoke(ctx context.Context, inst *instance, fn func(ctx context.Context, inst *instance) error) error {
+	callCtx, cancel := m.limits.callContext(ctx)
+	err := m.limits.classify(m.name, inst.mod, fn(m.withModule(callCtx), inst))
+	cancel()
+	m.calls.Add(1)
+	if err != nil {
+		m.failures.Add(1)
+	}
+	if isTrap(err) {
+		m.crash(ctx, inst, err)
+	}
+	return err
+}
+
+// Drain asks the module to finish its work and waits for calls in flight.
+// It returns nil once drain() reports 0 (or is not exported) and no call is
+// running, so the module can be closed, or ErrDrainTimeout after timeout.
+func (m *Module) Drain(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, hasDrain := m.compiled.ExportedFunctions()["drain"]
+	for {
+		var ms uint32
+		if hasDrain {
+			err := m.call(ctx, func(ctx context.Context, inst *instance) error {
+				results, err := inst.drainFn.Call(ctx)
+				if err == nil && len(results) > 0 {
+					ms = uint32(results[0])
+				}
+				return err
+			})
+			// With a CallTimeout the expired drain deadline reads as ErrCallTimeout.
+			if ctx.Err() != nil {
+				return m.drainTimeout()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if ms == 0 && m.active.Load() == 0 {
+			return nil
 		}
 
-		time.Sleep(time.Duration(ms) * time.Millisecond)
+		wait := time.Duration(ms) * time.Millisecond
+		if ms == 0 {
+			wait = drainPollInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return m.drainTimeout()
+		}
 	}
-	return nil
 }
 
+func (m *Module) drainTimeout() error {
+	return fmt.Errorf("%w: %s: %d calls in flight", ErrDrainTimeout, m.name, m.active.Load())
+}
+
+// Init calls init() on every instance created so far. The pool is locked
+// meanwhile, so a bus message for a subscription made by init() waits until
+// every instance is initialised rather than sharing one with init().
+//
+// Instances added to the pool later run init() as they are created, so init()
+// must be safe to repeat: one-time side effects, such as publishing a startup
+// event, happen again whenever the pool grows.
 func (m *Module) Init(ctx context.Context) error {
-	if m.initFn != nil {
-		_, err := m.initFn.Call(ctx)
+	ctx = m.withModule(ctx)
+	insts, err := m.pool.lockAll(ctx)
+	if err != nil {
 		return err
 	}
+	defer m.pool.unlockAll()
+	m.inited.Store(true)
+	for _, inst := range insts {
+		if err := m.initInstance(ctx, inst); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (m *Module) Close(ctx context.Context) error {
 	// Unsubscribe
-	for _, cleanup := range m.cleanups {
-		cleanup()
+	m.mu.Lock()
+	subs := m.subs
+	m.subs = make(map[uint32]*liveSub)
+	m.subIDs = make(map[subKey]uint32)
+	m.mu.Unlock()
+	for _, sub := range subs {
+		sub.stop()
 	}
 	return m.runtime.Close(ctx)
 }
 
-// Handle calls the module's handle() export. Returns the result ptr (into WASM memory).
-// Returns 0, nil if handleFn is nil.
-func (m *Module) Handle(ctx context.Context, reqPtr, reqLen uint32) (uint32, error) {
-	if m.handleFn == nil {
-		return 0, nil
+// Handle encodes req into a pooled instance and calls its handle() export.
+// Returns nil, nil if the module has no handle export or handle returned 0,
+// which lets a middleware pass the request on. A request held while a
+// hot-swap replaced the module is served by its replacement.
+func (m *Module) Handle(ctx context.Context, req *Request) (*Response, error) {
+	resp, err := m.handle(ctx, req)
+	if errors.Is(err, errModuleReplaced) {
+		m.holdMu.Lock()
+		next := m.next
+		m.holdMu.Unlock()
+		return next.Handle(ctx, req)
 	}
-	results, err := m.handleFn.Call(ctx, uint64(reqPtr), uint64(reqLen))
+	return resp, err
+}
+
+func (m *Module) handle(ctx context.Context, req *Request) (*Response, error) {
+	var resp *Response
+	err := m.call(ctx, func(ctx context.Context, inst *instance) error {
+		if inst.handleFn == nil {
+			return nil
+		}
+		body := req.encode()
+		ptr, err := inst.alloc(ctx, body)
+		if err != nil {
+			return err
+		}
+		if ptr == 0 {
+			return errors.New("wasi: cannot allocate request in " + m.name)
+		}
+		results, err := inst.handleFn.Call(ctx, uint64(ptr), uint64(len(body)))
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 || uint32(results[0]) == 0 {
+			return nil
+		}
+		resp, err = readResponse(inst.mod.Memory(), uint32(results[0]))
+		return err
+	})
+	return resp, err
+}
+
+// Snapshot calls the optional snapshot() export and returns a copy of the state it points to.
+// Each pooled instance has its own memory; only the instance the pool hands
+// out is asked, so state held by the others is not included.
+// snapshot may return (ptr, len uint32) or a single uint64 packed as ptr<<32 | len.
+// Returns nil, nil if the module does not export snapshot.
+func (m *Module) Snapshot(ctx context.Context) ([]byte, error) {
+	var state []byte
+	err := m.call(ctx, func(ctx context.Context, inst *instance) error {
+		if inst.snapshotFn == nil {
+			return nil
+		}
+		results, err := inst.snapshotFn.Call(ctx)
+		if err != nil {
+			return err
+		}
+		var ptr, n uint32
+		switch len(results) {
+		case 1:
+			ptr, n = uint32(results[0]>>32), uint32(results[0])
+		case 2:
+			ptr, n = uint32(results[0]), uint32(results[1])
+		default:
+			return errors.New("wasi: snapshot must return (ptr, len)")
+		}
+		buf, ok := inst.mod.Memory().Read(ptr, n)
+		if !ok {
+			return errors.New("wasi: snapshot out of memory bounds")
+		}
+		state = append([]byte{}, buf...)
+		return nil
+	})
+	return state, err
+}
+
+// Restore hands state to the restore() export of every instance created so far,
+// within the module's Limits. Like Init, it locks the pool meanwhile.
+// A non-zero status from restore is reported as an error.
+func (m *Module) Restore(ctx context.Context, state []byte) error {
+	ctx = m.withModule(ctx)
+	insts, err := m.pool.lockAll(ctx)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer m.pool.unlockAll()
+	for _, inst := range insts {
+		if err := m.restoreInstance(ctx, inst, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Module) restoreInstance(ctx context.Context, inst *instance, state []byte) error {
+	if inst.restoreFn == nil {
+		return nil
+	}
+	m.active.Add(1)
+	defer m.active.Add(-1)
+	return m.invoke(ctx, inst, func(ctx context.Context, inst *instance) error {
+		ptr, err := inst.alloc(ctx, state)
+		if err != nil {
+			return err
+		}
+		if ptr == 0 && len(state) > 0 {
+			return errors.New("wasi: cannot allocate state in " + m.name)
+		}
+		results, err := inst.restoreFn.Call(ctx, uint64(ptr), uint64(len(state)))
+		if err != nil {
+			return err
+		}
+		if len(results) > 0 && uint32(results[0]) != 0 {
+			return fmt.Errorf("wasi: %s restore returned status %d", m.name, uint32(results[0]))
+		}
+		return nil
+	})
+}
+
+// migrates reports whether state can move from m to next across a hot-swap.
+func (m *Module) migrates(next *Module) bool {
+	return m.implements("snapshot", func(i *instance) bool { return i.snapshotFn != nil }) &&
+		next.implements("restore", func(i *instance) bool { return i.restoreFn != nil })
+}
+
+// implements reports whether the module provides the optional export name,
+// after capabilities(). has tests a pooled instance; with none left, the
+// compiled module's exports decide.
+func (m *Module) implements(name string, has func(*instance) bool) bool {
+	if insts := m.pool.instances(); len(insts) > 0 {
+		return has(insts[0])
+	}
+	_, ok := m.compiled.ExportedFunctions()[name]
+	return ok
+}
+
+// readResponse decodes the length-prefixed response envelope at ptr.
+func readResponse(mem api.Memory, ptr uint32) (*Response, error) {
+	n, ok := mem.ReadUint32Le(ptr)
+	if !ok {
+		return nil, errEnvelope
 	}
-	if len(results) == 0 {
-		return 0, nil
+	buf, ok := mem.Read(ptr+4, n)
+	if !ok {
+		return nil, errEnvelope
+	}
+	return decodeResponse(buf)
+}
+
+// deliver hands a message on topic, subscribed with handler, to inst, or to
+// any pooled instance if inst is nil. on_envelope receives the whole encoded
+// binary.Message, its Topic set to topic if the publisher left it empty;
+// otherwise on_message gets the payload, with topic and handler in its
+// five-argument form.
+func (m *Module) deliver(ctx context.Context, inst *instance, topic string, handler uint32, msg binary.Message) error {
+	if msg.Topic == "" {
+		msg.Topic = topic
+	}
+	if msg.ID != 0 {
+		requestDelivered(msg.ID, m)
+	}
+	ctx = context.WithValue(ctx, messageIDKey{}, msg.ID)
+	return m.callOn(ctx, inst, func(ctx context.Context, inst *instance) error {
+		if inst.mallocFn == nil {
+			return nil
+		}
+		if inst.onEnvelope != nil {
+			var encoded []byte
+			if err := binary.Encode(&msg, &encoded); err != nil {
+				return err
+			}
+			ptr, err := inst.alloc(ctx, encoded)
+			if err != nil || ptr == 0 {
+				return err
+			}
+			_, err = inst.onEnvelope.Call(ctx, uint64(ptr), uint64(len(encoded)), uint64(handler))
+			return err
+		}
+		if inst.onMessageFn == nil {
+			return nil
+		}
+		payload := msg.Payload
+		ptr, err := inst.alloc(ctx, payload)
+		if err != nil || ptr == 0 {
+			return err
+		}
+		if !inst.topicAware {
+			_, err = inst.onMessageFn.Call(ctx, uint64(ptr), uint64(len(payload)))
+			return err
+		}
+		topicPtr, err := inst.alloc(ctx, []byte(topic))
+		if err != nil || topicPtr == 0 {
+			return err
+		}
+		_, err = inst.onMessageFn.Call(ctx, uint64(topicPtr), uint64(len(topic)), uint64(ptr), uint64(len(payload)), uint64(handler))
+		return err
+	})
+}
+
+// addSubscription records a bus subscription for the module and returns its ID.
+//
+// With a nil inst the subscription was made by init() or restore(), which every
+// instance runs alike: it is shared by the module and delivered to any instance.
+// If the module already subscribed topic with handler, even if it has since
+// unsubscribed, the existing ID is returned and subscribe is not called.
+//
+// Otherwise handler is only meaningful in inst, so the subscription is its own
+// and subscribe must deliver to it; it is cancelled when inst leaves the pool.
+func (m *Module) addSubscription(topic string, handler uint32, inst *instance, subscribe func() func()) uint32 {
+	key := subKey{topic: topic, handler: handler}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subs == nil {
+		m.subs = make(map[uint32]*liveSub)
+		m.subIDs = make(map[subKey]uint32)
+	}
+	if inst == nil {
+		if id, ok := m.subIDs[key]; ok {
+			return id
+		}
+	}
+	m.nextSubID++
+	id := m.nextSubID
+	if inst == nil {
+		m.subIDs[key] = id
+	}
+	sub := &liveSub{
+		Subscription: Subscription{ID: id, Topic: topic, Handler: handler},
+		inst:         inst,
+		subscribe:    subscribe,
+	}
+	if !m.offBus {
+		sub.cancel = subscribe()
+	}
+	m.subs[id] = sub
+	return id
+}
+
+// holdSubscriptions takes the module's subscriptions off the bus until
+// connectSubscriptions, so a canary does not handle every message a second
+// time next to the version it may replace, and a module being retired gets no
+// new messages while it drains.
+func (m *Module) holdSubscriptions() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offBus = true
+	for _, sub := range m.subs {
+		sub.stop()
+		sub.cancel = nil
+	}
+}
+
+// connectSubscriptions makes the subscriptions held by holdSubscriptions.
+func (m *Module) connectSubscriptions() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offBus = false
+	for _, sub := range m.subs {
+		if sub.cancel == nil {
+			sub.cancel = sub.subscribe()
+		}
+	}
+}
+
+// removeSubscription cancels subscription id. Returns false if it is not live.
+func (m *Module) removeSubscription(id uint32) bool {
+	m.mu.Lock()
+	sub, ok := m.subs[id]
+	if ok {
+		delete(m.subs, id)
+	}
+	m.mu.Unlock()
+	if ok {
+		sub.stop()
+	}
+	return ok
+}
+
+// dropSubscriptions cancels the subscriptions pinned to inst.
+func (m *Module) dropSubscriptions(inst *instance) {
+	m.mu.Lock()
+	var dropped []*liveSub
+	for id, sub := range m.subs {
+		if sub.inst == inst {
+			delete(m.subs, id)
+			dropped = append(dropped, sub)
+		}
+	}
+	m.mu.Unlock()
+	for _, sub := range dropped {
+		sub.stop()
+	}
+}
+
+// Subscriptions returns the module's live bus subscriptions ordered by ID.
+func (m *Module) Subscriptions() []Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Subscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		out = append(out, sub.Subscription)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Exports returns the names of the functions the module exports, sorted.
+func (m *Module) Exports() []string {
+	defs := m.compiled.ExportedFunctions()
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
 	}
-	return uint32(results[0]), nil
+	sort.Strings(names)
+	return names
 }
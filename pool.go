@@ -0,0 +1,288 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// instance is one wazero instantiation of a module's compiled code.
+// An instance is never used by more than one goroutine at a time.
+type instance struct {
+	mod         api.Module
+	drainFn     api.Function // exported drain() uint32
+	initFn      api.Function // exported init()
+	handleFn    api.Function // optional: exported handle(req_ptr, req_len uint32) uint32
+	onMessageFn api.Function // optional: exported on_message, see topicAware
+	topicAware  bool         // on_message(topic_ptr, topic_len, msg_ptr, msg_len, handler) rather than on_message(ptr, len)
+	onEnvelope  api.Function // optional: exported on_envelope(msg_ptr, msg_len, handler), preferred over on_message
+	mallocFn    api.Function // exported malloc(size uint32) or alloc(size uint32)
+	snapshotFn  api.Function // optional: exported snapshot() (ptr, len) for hot-swap state migration
+	restoreFn   api.Function // optional: exported restore(ptr, len uint32) [status uint32]
+	healthFn    api.Function // optional: exported health() uint32, 0 = ready
+}
+
+func newInstance(mod api.Module) *instance {
+	inst := &instance{
+		mod:         mod,
+		drainFn:     mod.ExportedFunction("drain"),
+		initFn:      mod.ExportedFunction("init"),
+		handleFn:    mod.ExportedFunction("handle"),
+		onMessageFn: mod.ExportedFunction("on_message"),
+		onEnvelope:  mod.ExportedFunction("on_envelope"),
+		mallocFn:    exportedMalloc(mod),
+		snapshotFn:  mod.ExportedFunction("snapshot"),
+		restoreFn:   mod.ExportedFunction("restore"),
+		healthFn:    mod.ExportedFunction("health"),
+	}
+	if inst.onMessageFn != nil {
+		inst.topicAware = len(inst.onMessageFn.Definition().ParamTypes()) == 5
+	}
+	return inst
+}
+
+// Bits of the optional capabilities() uint32 export, by which a module whose
+// SDK exports snapshot, restore and health unconditionally reports which of
+// them it implements. Modules without the export implement what they export.
+const (
+	capSnapshot uint32 = 1 << iota
+	capRestore
+	capHealth
+)
+
+// applyCapabilities drops the optional exports capabilities() reports as
+// not implemented, so the host never calls them.
+func (i *instance) applyCapabilities(ctx context.Context) error {
+	fn := i.mod.ExportedFunction("capabilities")
+	if fn == nil {
+		return nil
+	}
+	results, err := fn.Call(ctx)
+	if err != nil || len(results) == 0 {
+		return err
+	}
+	caps := uint32(results[0])
+	if caps&capSnapshot == 0 {
+		i.snapshotFn = nil
+	}
+	if caps&capRestore == 0 {
+		i.restoreFn = nil
+	}
+	if caps&capHealth == 0 {
+		i.healthFn = nil
+	}
+	return nil
+}
+
+// alloc reserves len(data) bytes in the guest via its malloc export and copies data into it.
+// Returns 0 when the guest exports no allocator or the write fails.
+func (i *instance) alloc(ctx context.Context, data []byte) (uint32, error) {
+	return guestAlloc(ctx, i.mallocFn, i.mod.Memory(), data)
+}
+
+// exportedMalloc returns the guest's malloc export, falling back to alloc.
+func exportedMalloc(mod api.Module) api.Function {
+	if fn := mod.ExportedFunction("malloc"); fn != nil {
+		return fn
+	}
+	return mod.ExportedFunction("alloc")
+}
+
+func guestAlloc(ctx context.Context, malloc api.Function, mem api.Memory, data []byte) (uint32, error) {
+	if malloc == nil {
+		return 0, nil
+	}
+	results, err := malloc.Call(ctx, uint64(len(data)))
+	if err != nil || len(results) == 0 {
+		return 0, err
+	}
+	ptr := uint32(results[0])
+	if !mem.Write(ptr, data) {
+		return 0, nil
+	}
+	return ptr, nil
+}
+
+// instancePool hands out exclusive instances of a module, growing lazily up to max.
+type instancePool struct {
+	mu    sync.Mutex
+	all   []*instance
+	idle  []*instance
+	slots chan struct{} // one token per instance checked out or being created
+	freed chan struct{} // closed when an instance is returned; see acquireInstance
+	newFn func(ctx context.Context) (*instance, error)
+}
+
+// errInstanceGone is returned by acquireInstance once the instance has left the pool.
+var errInstanceGone = errors.New("wasi: instance closed")
+
+func newInstancePool(max int, newFn func(ctx context.Context) (*instance, error)) *instancePool {
+	if max < 1 {
+		max = 1
+	}
+	return &instancePool{
+		slots: make(chan struct{}, max),
+		newFn: newFn,
+	}
+}
+
+// fill creates instances until the pool holds n of them.
+func (p *instancePool) fill(ctx context.Context, n int) error {
+	for p.size() < n && p.size() < cap(p.slots) {
+		inst, err := p.newFn(ctx)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.all = append(p.all, inst)
+		p.idle = append(p.idle, inst)
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// acquire blocks until an instance is free or ctx is done.
+func (p *instancePool) acquire(ctx context.Context) (*instance, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		inst := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return inst, nil
+	}
+	p.mu.Unlock()
+
+	inst, err := p.newFn(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.mu.Lock()
+	p.all = append(p.all, inst)
+	p.mu.Unlock()
+	return inst, nil
+}
+
+// acquireInstance blocks until inst itself is free or ctx is done.
+func (p *instancePool) acquireInstance(ctx context.Context, inst *instance) (*instance, error) {
+	for {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+		if i := slices.Index(p.idle, inst); i >= 0 {
+			p.idle = slices.Delete(p.idle, i, i+1)
+			p.mu.Unlock()
+			return inst, nil
+		}
+		gone := !slices.Contains(p.all, inst)
+		if p.freed == nil {
+			p.freed = make(chan struct{})
+		}
+		freed := p.freed
+		p.mu.Unlock()
+		<-p.slots
+		if gone {
+			return nil, errInstanceGone
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release returns inst to the pool.
+func (p *instancePool) release(inst *instance) {
+	p.mu.Lock()
+	p.idle = append(p.idle, inst)
+	p.notifyFreed()
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// notifyFreed wakes acquireInstance callers. p.mu must be held.
+func (p *instancePool) notifyFreed() {
+	if p.freed != nil {
+		close(p.freed)
+		p.freed = nil
+	}
+}
+
+// discard drops inst from the pool; a replacement is created on demand.
+func (p *instancePool) discard(inst *instance) {
+	p.mu.Lock()
+	for i, x := range p.all {
+		if x == inst {
+			p.all = append(p.all[:i], p.all[i+1:]...)
+			break
+		}
+	}
+	p.notifyFreed()
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// lockAll waits until no instance is checked out or being created, then keeps
+// the pool to the caller until unlockAll, so it can call every instance in
+// turn without racing other calls. It returns the pool's instances.
+func (p *instancePool) lockAll(ctx context.Context) ([]*instance, error) {
+	for i := 0; i < cap(p.slots); i++ {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			for ; i > 0; i-- {
+				<-p.slots
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return p.instances(), nil
+}
+
+// unlockAll reopens a pool locked by lockAll, dropping instances closed meanwhile.
+func (p *instancePool) unlockAll() {
+	p.mu.Lock()
+	p.all = withoutClosed(p.all)
+	p.idle = withoutClosed(p.idle)
+	p.notifyFreed()
+	p.mu.Unlock()
+	for i := 0; i < cap(p.slots); i++ {
+		<-p.slots
+	}
+}
+
+func withoutClosed(insts []*instance) []*instance {
+	out := insts[:0]
+	for _, inst := range insts {
+		if !inst.mod.IsClosed() {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+// instances returns a snapshot of every instance created so far.
+func (p *instancePool) instances() []*instance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*instance(nil), p.all...)
+}
+
+func (p *instancePool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.all)
+}
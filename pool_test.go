@@ -0,0 +1,323 @@
+package wasi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinywasm/binary"
+	"github.com/tinywasm/bus"
+)
+
+// blockingHandleWasm exports handle(), which calls env.log before responding "ok".
+func blockingHandleWasm() []byte {
+	f := &wasmFixture{}
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1).dataAt(16, encodeResponse(&Response{Body: []byte("ok")}))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, ops(
+		i32Const(0), i32Const(0), call(logFn),
+		i32Const(16),
+	)...)
+	return f.bytes()
+}
+
+func TestModule_ConcurrentHandle(t *testing.T) {
+	entered := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+	logger := func(msg ...any) {
+		entered <- struct{}{}
+		<-unblock
+	}
+
+	ctx := context.Background()
+	mod, err := LoadWithConfig(ctx, "blocking", blockingHandleWasm(), NewHostBuilder(bus.New(), nil, logger), LoadConfig{PoolMin: 1, PoolMax: 2})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer mod.Close(ctx)
+
+	var wg sync.WaitGroup
+	results := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := mod.Handle(ctx, &Request{Method: "GET", URL: "/m/blocking"})
+			if err != nil {
+				t.Errorf("Handle failed: %v", err)
+			}
+			var body string
+			if out != nil {
+				body = string(out.Body)
+			}
+			results <- body
+		}()
+	}
+
+	// Both calls must be inside the guest at the same time, each on its own instance.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-entered:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handle calls did not run concurrently")
+		}
+	}
+	if got := mod.pool.size(); got != 2 {
+		t.Errorf("pool size = %d, want 2", got)
+	}
+
+	// The pool is exhausted: a third call must wait for a free instance.
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := mod.Handle(short, &Request{Method: "GET", URL: "/m/blocking"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Handle on exhausted pool: got %v, want deadline exceeded", err)
+	}
+
+	close(unblock)
+	wg.Wait()
+	close(results)
+	for out := range results {
+		if out != "ok" {
+			t.Errorf("Handle returned %q, want %q", out, "ok")
+		}
+	}
+}
+
+func TestModule_InitSubscribesOnce(t *testing.T) {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	f.memory(1).dataAt(0, []byte("events"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(6), i32Const(0), call(subFn), drop(),
+	)...)
+
+	ctx := context.Background()
+	mod, err := LoadWithConfig(ctx, "sub", f.bytes(), NewHostBuilder(bus.New(), nil, nil), LoadConfig{PoolMin: 3})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer mod.Close(ctx)
+
+	if err := mod.Init(ctx); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if got := mod.pool.size(); got != 3 {
+		t.Errorf("pool size = %d, want 3", got)
+	}
+	if got := len(mod.Subscriptions()); got != 1 {
+		t.Errorf("subscriptions = %d, want 1", got)
+	}
+}
+
+func TestModule_TopicAwareOnMessage(t *testing.T) {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1).dataAt(0, []byte("a")).dataAt(8, []byte("b")).dataAt(16, []byte("h2"))
+	// Bump allocator: the next free address is stored at 512.
+	f.dataAt(512, []byte{0, 4, 0, 0})
+	f.fn("malloc", []byte{i32}, []byte{i32}, []byte{i32}, ops(
+		i32Const(512), []byte{0x28, 0x02, 0x00}, []byte{0x21, 0x01}, // local1 = mem[512]
+		i32Const(512), localGet(1), localGet(0), []byte{0x6a}, []byte{0x36, 0x02, 0x00}, // mem[512] = local1 + size
+		localGet(1),
+	)...)
+	// on_message logs topic and payload, then "h2" when handler == 2.
+	f.fn("on_message", []byte{i32, i32, i32, i32, i32}, nil, nil, ops(
+		localGet(0), localGet(1), call(logFn),
+		localGet(2), localGet(3), call(logFn),
+		localGet(4), i32Const(2), []byte{0x46, 0x04, 0x40},
+		i32Const(16), i32Const(2), call(logFn),
+		[]byte{0x0b},
+	)...)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(1), i32Const(1), call(subFn), drop(),
+		i32Const(8), i32Const(1), i32Const(2), call(subFn), drop(),
+	)...)
+
+	var mu sync.Mutex
+	var logged []string
+	b := bus.New()
+	hb := NewHostBuilder(b, nil, func(msg ...any) {
+		mu.Lock()
+		logged = append(logged, msg[1].(string))
+		mu.Unlock()
+	})
+	ctx := context.Background()
+	mod, err := LoadWithConfig(ctx, "sub", f.bytes(), hb, LoadConfig{})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer mod.Close(ctx)
+	if err := mod.Init(ctx); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	b.Publish("a", binary.Message{Payload: []byte("x")})
+	time.Sleep(50 * time.Millisecond)
+	b.Publish("b", binary.Message{Payload: []byte("y")})
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"a", "x", "b", "y", "h2"}
+	if !reflect.DeepEqual(logged, want) {
+		t.Errorf("on_message logged %q, want %q", logged, want)
+	}
+}
+
+func TestModule_InitHoldsDeliveries(t *testing.T) {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1).dataAt(0, []byte("t")).dataAt(8, []byte("init")).dataAt(16, []byte("msg"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil, ops(i32Const(16), i32Const(3), call(logFn))...)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(1), i32Const(0), call(subFn), drop(),
+		i32Const(8), i32Const(4), call(logFn),
+	)...)
+
+	inInit := make(chan struct{})
+	unblock := make(chan struct{})
+	delivered := make(chan struct{}, 1)
+	b := bus.New()
+	hb := NewHostBuilder(b, nil, func(msg ...any) {
+		switch msg[1] {
+		case "init":
+			close(inInit)
+			<-unblock
+		case "msg":
+			delivered <- struct{}{}
+		}
+	})
+	ctx := context.Background()
+	mod, err := LoadWithConfig(ctx, "sub", f.bytes(), hb, LoadConfig{PoolMin: 1, PoolMax: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+
+	initDone := make(chan error, 1)
+	go func() { initDone <- mod.Init(ctx) }()
+	<-inInit
+	b.Publish("t", binary.Message{Payload: []byte("x")})
+	select {
+	case <-delivered:
+		t.Fatal("message delivered while init() was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	if err := <-initDone; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("message held during init() was never delivered")
+	}
+}
+
+func TestModule_RuntimeSubscriptionPinned(t *testing.T) {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1).dataAt(0, []byte("t")).dataAt(16, []byte("mine"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	// on_message logs "mine" in the instance whose handle() subscribed, "" elsewhere.
+	f.fn("on_message", []byte{i32, i32}, nil, nil, ops(
+		i32Const(16), i32Const(100), []byte{0x28, 0x02, 0x00}, call(logFn),
+	)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, ops(
+		i32Const(100), i32Const(4), []byte{0x36, 0x02, 0x00},
+		i32Const(0), i32Const(1), i32Const(7), call(subFn), drop(),
+		i32Const(0),
+	)...)
+
+	logs := make(chan any, 32)
+	b := bus.New()
+	hb := NewHostBuilder(b, nil, func(msg ...any) { logs <- msg[1] })
+	ctx := context.Background()
+	mod, err := LoadWithConfig(ctx, "sub", f.bytes(), hb, LoadConfig{PoolMin: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+	if err := mod.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mod.Handle(ctx, &Request{Method: "GET", URL: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the subscribing instance busy while messages arrive, so the other
+	// instance is free to take them.
+	busy, err := mod.pool.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark, _ := busy.mod.Memory().ReadUint32Le(100); mark != 4 {
+		t.Fatal("acquired the instance that did not subscribe")
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		b.Publish("t", binary.Message{Payload: []byte("x")})
+	}
+	select {
+	case got := <-logs:
+		t.Fatalf("message delivered while the subscribing instance was busy (logged %q)", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mod.pool.release(busy)
+	for i := 0; i < n; i++ {
+		select {
+		case got := <-logs:
+			if got != "mine" {
+				t.Fatalf("message delivered to an instance that did not subscribe (logged %q)", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d messages delivered", i, n)
+		}
+	}
+}
+
+func TestModule_UnsubscribeSurvivesPoolGrowth(t *testing.T) {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	unsubFn := f.imp("unsubscribe", []byte{i32}, []byte{i32})
+	f.memory(1).dataAt(0, []byte("t"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(1), i32Const(0), call(subFn), drop(),
+	)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, ops(
+		i32Const(1), call(unsubFn), drop(),
+		i32Const(0),
+	)...)
+
+	ctx := context.Background()
+	mod, err := LoadWithConfig(ctx, "sub", f.bytes(), NewHostBuilder(bus.New(), nil, nil), LoadConfig{PoolMin: 1, PoolMax: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+	if err := mod.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mod.Handle(ctx, &Request{Method: "GET", URL: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.pool.fill(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if subs := mod.Subscriptions(); len(subs) != 0 {
+		t.Errorf("subscriptions after the pool grew = %v, want none", subs)
+	}
+}
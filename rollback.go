@@ -0,0 +1,63 @@
+package wasi
+
+import (
+	"fmt"
+	"time"
+)
+
+// RollbackPolicy reinstates the previous version of a module when the one just
+// hot-swapped in fails too often: more than MaxErrorRate of at least MinCalls
+// calls within Window after the swap.
+type RollbackPolicy struct {
+	Window       time.Duration // grace period watched after each swap; 0 disables
+	MaxErrorRate float64       // failed/total calls, 0-1
+	MinCalls     uint64        // calls needed before the rate counts; default 1
+}
+
+// SetAutoRollback enables automatic rollback after hot-swaps. Disabled by default.
+func (s *WasiServer) SetAutoRollback(p RollbackPolicy) *WasiServer {
+	if p.MinCalls == 0 {
+		p.MinCalls = 1
+	}
+	s.rollback = p
+	return s
+}
+
+// watchSwap monitors mod, just swapped in as name, for p.Window and reinstates
+// prev if its error rate crosses the policy. It stops early if mod is replaced.
+func (s *WasiServer) watchSwap(name string, mod *Module, prev *version) {
+	p := s.rollback
+	if p.Window <= 0 || prev == nil {
+		return
+	}
+	tick := max(p.Window/20, 10*time.Millisecond)
+	go func() {
+		deadline := time.Now().Add(p.Window)
+		for time.Now().Before(deadline) {
+			time.Sleep(tick)
+			if !s.serves(name, mod) {
+				return
+			}
+			calls, failures := mod.calls.Load(), mod.failures.Load()
+			if calls < p.MinCalls || float64(failures)/float64(calls) <= p.MaxErrorRate {
+				continue
+			}
+			l := s.swapLock(name)
+			l.Lock()
+			// Another swap may have replaced mod while we waited for the lock.
+			if s.serves(name, mod) {
+				s.logger(fmt.Sprintf("Auto-rollback %s to version %d: %d of %d calls failed within %s of the swap", name, prev.Version.Version, failures, calls, p.Window))
+				if err := s.installModuleLocked(name, prev.bytes, prev.Source, prev); err != nil {
+					s.logger("Auto-rollback error:", err)
+				}
+			}
+			l.Unlock()
+			return
+		}
+	}()
+}
+
+// serves reports whether mod is the module or middleware serving name.
+func (s *WasiServer) serves(name string, mod *Module) bool {
+	return s.loadedModule(name, false) == mod || s.loadedModule(name, true) == mod
+}
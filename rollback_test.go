@@ -0,0 +1,89 @@
+package wasi
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trapHandleWasm exports handle(), which always traps.
+func trapHandleWasm() []byte {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, 0x00) // unreachable
+	return f.bytes()
+}
+
+func TestWasiServer_AutoRollback(t *testing.T) {
+	var logs logRecorder
+	srv := New().SetAppRootDir(t.TempDir()).SetLogger(logs.log).
+		SetAutoRollback(RollbackPolicy{Window: time.Second, MaxErrorRate: 0.5, MinCalls: 3})
+	if err := srv.swapModule("users", staticHandleWasm("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.swapModule("users", trapHandleWasm()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		srv.handleMiddlewareDispatch(rec, httptest.NewRequest("GET", "/m/users", nil))
+		if rec.Code != 500 {
+			t.Fatalf("trapping module answered %d", rec.Code)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for dispatchBody(srv, httptest.NewRequest("GET", "/m/users", nil)) != "v1" {
+		if time.Now().After(deadline) {
+			t.Fatal("previous version not reinstated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !logs.contains("Auto-rollback users to version 1:") {
+		t.Errorf("rollback reason not logged: %q", logs.lines())
+	}
+}
+
+func TestWasiServer_AutoRollbackHealthy(t *testing.T) {
+	srv := New().SetAppRootDir(t.TempDir()).
+		SetAutoRollback(RollbackPolicy{Window: 200 * time.Millisecond, MaxErrorRate: 0.5})
+	srv.swapModule("users", staticHandleWasm("v1"))
+	srv.swapModule("users", staticHandleWasm("v2"))
+
+	time.Sleep(300 * time.Millisecond)
+	if got := dispatchBody(srv, httptest.NewRequest("GET", "/m/users", nil)); got != "v2" {
+		t.Errorf("healthy module replaced: served by %q", got)
+	}
+}
+
+// logRecorder collects WasiServer log lines.
+type logRecorder struct {
+	mu  sync.Mutex
+	out []string
+}
+
+func (r *logRecorder) log(msg ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out = append(r.out, fmt.Sprint(msg...))
+}
+
+func (r *logRecorder) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.out...)
+}
+
+func (r *logRecorder) contains(s string) bool {
+	for _, line := range r.lines() {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package wasi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+)
+
+// SetTLS serves HTTPS, WSS and HTTP/2 with the PEM certificate and key files,
+// loaded when the server starts.
+func (s *WasiServer) SetTLS(certFile, keyFile string) *WasiServer {
+	s.tlsCertFile, s.tlsKeyFile = certFile, keyFile
+	return s
+}
+
+// SetTLSConfig serves HTTPS, WSS and HTTP/2 with cfg, e.g. for certificates
+// held in memory or chosen through cfg.GetCertificate. It takes precedence
+// over SetTLS.
+func (s *WasiServer) SetTLSConfig(cfg *tls.Config) *WasiServer {
+	s.tlsConfig = cfg
+	return s
+}
+
+// SetSelfSignedTLS serves HTTPS with a certificate generated at startup for
+// hosts (default localhost, 127.0.0.1 and ::1). Browsers will warn about it;
+// use it for local development only.
+func (s *WasiServer) SetSelfSignedTLS(hosts ...string) *WasiServer {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	s.tlsSelfSigned = hosts
+	return s
+}
+
+// serverTLSConfig returns the TLS config to serve with, or nil for plain HTTP.
+func (s *WasiServer) serverTLSConfig() (*tls.Config, error) {
+	switch {
+	case s.tlsConfig != nil:
+		return s.tlsConfig.Clone(), nil
+	case s.tlsCertFile != "":
+		cert, err := tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case len(s.tlsSelfSigned) > 0:
+		cert, err := selfSignedCert(s.tlsSelfSigned)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	return nil, nil
+}
+
+// selfSignedCert creates a one-year ECDSA certificate for hosts, which may
+// be DNS names or IP addresses.
+func selfSignedCert(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"tinywasm/wasi development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,77 @@
+package wasi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWasiServer_SelfSignedTLS(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tmp := t.TempDir()
+	srv := New().SetPort(fmt.Sprintf("%d", port)).SetAppRootDir(tmp).SetOutputDir(tmp).SetSelfSignedTLS()
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	defer srv.StopServer()
+	waitForPort(t, port)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(fmt.Sprintf("https://localhost:%d/healthz", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("GET /healthz = %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+	if names := resp.TLS.PeerCertificates[0].DNSNames; len(names) != 1 || names[0] != "localhost" {
+		t.Errorf("certificate DNS names = %v", names)
+	}
+}
+
+func TestWasiServer_TLSFiles(t *testing.T) {
+	cert, err := selfSignedCert([]string{"example.test", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+
+	cfg, err := New().SetTLS(certFile, keyFile).serverTLSConfig()
+	if err != nil || cfg == nil || len(cfg.Certificates) != 1 {
+		t.Fatalf("serverTLSConfig = %v, %v", cfg, err)
+	}
+	leaf, _ := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if leaf.DNSNames[0] != "example.test" || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("loaded certificate for %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	if _, err := New().SetTLS(filepath.Join(dir, "missing.pem"), keyFile).serverTLSConfig(); err == nil {
+		t.Error("missing certificate file accepted")
+	}
+	if cfg, _ := New().serverTLSConfig(); cfg != nil {
+		t.Error("TLS enabled without configuration")
+	}
+}
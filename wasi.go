@@ -2,12 +2,19 @@ package wasi
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -15,6 +22,9 @@ import (
 	"github.com/tinywasm/gobuild"
 )
 
+// maxRequestBody caps the body read for /m/{name} requests.
+const maxRequestBody = 10 << 20
+
 type WasiServer struct {
 	// Config
 	appRootDir string
@@ -24,8 +34,31 @@ type WasiServer struct {
 
 	// Internal
 	drainTimeout    time.Duration
+	poolMin         int
+	poolMax         int
+	limits          Limits
+	moduleLimits    map[string]Limits
+	rollback        RollbackPolicy
+	historyLimit    int
+	restart         RestartPolicy
+	admin           AdminConfig
+	metrics         *Metrics
+	metricsPath     string
+	livenessPath    string
+	readinessPath   string
+	ready           atomic.Bool // startup compile and load pass finished
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsConfig       *tls.Config
+	tlsSelfSigned   []string // hosts of the generated certificate
+	listenAddr      string
+	listener        net.Listener
+	addr            net.Addr // bound address, guarded by mu
+	cacheDir        string
 	routes          []func(*http.ServeMux)
 	bus             bus.Bus
+	kv              KVStore
+	wsInboundPrefix string
 	exitChan        chan bool
 	logger          func(...any)
 	ui              interface{ RefreshUI() }
@@ -34,30 +67,59 @@ type WasiServer struct {
 	// Runtime
 	mux         *http.ServeMux
 	httpSrv     *http.Server
+	adminSrv    *http.Server // admin API on its own listener, if configured
 	modules     map[string]*Module
-	mu          sync.RWMutex
+	canaries    map[string]*canary
+	history     map[string]*moduleHistory
+	swapLocks   sync.Map     // module name → *sync.Mutex, see swapLock
+	mu          sync.RWMutex // guards modules, canaries, history, wsHub and addr
 	middlewares []*MiddlewareModule
 	muMw        sync.RWMutex
 	wsHub       *wsHub
 	watcher     *fsnotify.Watcher
 	builder     *gobuild.GoBuild
+	cache       *CompilationCache
+	muCache     sync.Mutex
 }
 
 // New creates a WasiServer with all defaults. Configure via Set* methods.
 func New() *WasiServer {
 	wd, _ := os.Getwd()
-	return &WasiServer{
-		appRootDir:   wd,
-		modulesDir:   "modules",
-		outputDir:    "modules/dist",
-		port:         "6060",
-		drainTimeout: 5 * time.Second,
-		exitChan:     make(chan bool),
-		logger:       func(msg ...any) {},
-		ui:           noopUI{},
-		bus:          bus.New(),
-		modules:      make(map[string]*Module),
+	s := &WasiServer{
+		appRootDir:      wd,
+		modulesDir:      "modules",
+		outputDir:       "modules/dist",
+		port:            "6060",
+		drainTimeout:    5 * time.Second,
+		historyLimit:    defaultHistoryLimit,
+		poolMin:         1,
+		poolMax:         runtime.NumCPU(),
+		exitChan:        make(chan bool),
+		logger:          func(msg ...any) {},
+		ui:              noopUI{},
+		bus:             bus.New(),
+		kv:              NewMemoryKV(),
+		wsInboundPrefix: defaultWSInboundPrefix,
+		modules:         make(map[string]*Module),
+		canaries:        make(map[string]*canary),
+		history:         make(map[string]*moduleHistory),
+		metrics:         NewMetrics(),
+		metricsPath:     "/metrics",
+		livenessPath:    "/healthz",
+		readinessPath:   "/readyz",
 	}
+	s.metrics.Gauge("wasi_ws_clients", "Open /ws connections.", func() float64 {
+		return float64(s.hub().clientCount())
+	})
+	s.metrics.Gauge("wasi_modules_loaded", "Modules and middlewares currently serving.", func() float64 {
+		s.muMw.RLock()
+		n := len(s.middlewares)
+		s.muMw.RUnlock()
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(n + len(s.modules))
+	})
+	return s
 }
 
 type noopUI struct{}
@@ -89,6 +151,84 @@ func (s *WasiServer) SetDrainTimeout(d time.Duration) *WasiServer {
 	return s
 }
 
+// SetPoolSize bounds the number of instances kept per module.
+// min instances are created at load time; more are added under concurrent load, up to max.
+func (s *WasiServer) SetPoolSize(min, max int) *WasiServer {
+	s.poolMin = min
+	s.poolMax = max
+	return s
+}
+
+// SetLimits sets the resource limits applied to every module.
+func (s *WasiServer) SetLimits(l Limits) *WasiServer {
+	s.limits = l
+	return s
+}
+
+// SetModuleLimits overrides the resource limits for the module called name.
+func (s *WasiServer) SetModuleLimits(name string, l Limits) *WasiServer {
+	if s.moduleLimits == nil {
+		s.moduleLimits = make(map[string]Limits)
+	}
+	s.moduleLimits[name] = l
+	return s
+}
+
+// SetRestartPolicy bounds how often modules' crashed instances are replaced
+// before the module is marked unhealthy. Default: no limit.
+func (s *WasiServer) SetRestartPolicy(p RestartPolicy) *WasiServer {
+	s.restart = p
+	return s
+}
+
+// SetCompilationCacheDir persists compiled modules in dir, shared by every module runtime.
+// Restarts and hot-reloads of unchanged modules then skip compilation.
+func (s *WasiServer) SetCompilationCacheDir(dir string) *WasiServer {
+	s.cacheDir = dir
+	return s
+}
+
+// CacheStats returns compilation cache hits and misses; zero if no cache is configured.
+func (s *WasiServer) CacheStats() CacheStats {
+	s.muCache.Lock()
+	defer s.muCache.Unlock()
+	if s.cache == nil {
+		return CacheStats{}
+	}
+	return s.cache.Stats()
+}
+
+// Subscriptions returns the live bus subscriptions of module name, or nil if it is not loaded.
+func (s *WasiServer) Subscriptions(name string) []Subscription {
+	mod := s.loadedModule(name, false)
+	if mod == nil {
+		mod = s.loadedModule(name, true)
+	}
+	if mod == nil {
+		return nil
+	}
+	return mod.Subscriptions()
+}
+
+// SetMetricsPath sets the route serving Prometheus metrics. Default "/metrics";
+// "" disables the route, though metrics are still recorded.
+func (s *WasiServer) SetMetricsPath(path string) *WasiServer {
+	s.metricsPath = path
+	return s
+}
+
+// SetHealthPaths sets the liveness and readiness routes. Default "/healthz"
+// and "/readyz"; "" disables a route, e.g. when the application serves its own.
+func (s *WasiServer) SetHealthPaths(liveness, readiness string) *WasiServer {
+	s.livenessPath, s.readinessPath = liveness, readiness
+	return s
+}
+
+// Metrics returns the server's metrics, for serving them on another route.
+func (s *WasiServer) Metrics() *Metrics {
+	return s.metrics
+}
+
 func (s *WasiServer) SetLogger(fn func(msg ...any)) *WasiServer {
 	s.logger = fn
 	return s
@@ -109,6 +249,19 @@ func (s *WasiServer) SetBus(b bus.Bus) *WasiServer {
 	return s
 }
 
+// SetKVStore sets the store behind the kv_* host functions. Defaults to NewMemoryKV().
+func (s *WasiServer) SetKVStore(store KVStore) *WasiServer {
+	s.kv = store
+	return s
+}
+
+// SetWSInboundPrefix sets the bus topic prefix for messages sent by WebSocket clients.
+// A client on /ws?topic=chat publishes to prefix+"chat". Defaults to "ws.".
+func (s *WasiServer) SetWSInboundPrefix(prefix string) *WasiServer {
+	s.wsInboundPrefix = prefix
+	return s
+}
+
 func (s *WasiServer) SetExternalWatcher(enable bool) *WasiServer {
 	s.externalWatcher = enable
 	return s
@@ -130,17 +283,32 @@ func (s *WasiServer) StartServer(wg *sync.WaitGroup) {
 		route(s.mux)
 	}
 
-	// Initialize wsHub if not present
-	if s.wsHub == nil {
-		s.wsHub = &wsHub{
-			clients: make(map[string]map[*wsConn]bool),
-			bus:     s.bus,
-		}
-	}
-	s.wsHub.RegisterRoute(s.mux)
+	s.hub().RegisterRoute(s.mux)
 
 	// Register middleware dispatcher
 	s.mux.HandleFunc("/m/", s.handleMiddlewareDispatch)
+	if s.metricsPath != "" {
+		s.mux.Handle(s.metricsPath, s.metrics)
+	}
+	if s.livenessPath != "" {
+		s.mux.HandleFunc(s.livenessPath, s.handleHealthz)
+	}
+	if s.readinessPath != "" {
+		s.mux.HandleFunc(s.readinessPath, s.handleReadyz)
+	}
+
+	// Admin API, on the main mux or its own listener
+	switch {
+	case s.admin.Path == "":
+	case s.admin.Token == "":
+		s.logger("Admin API disabled: no token configured")
+	case s.admin.Port == "" && s.admin.Addr == "":
+		s.registerAdmin(s.mux)
+	default:
+		adminMux := http.NewServeMux()
+		s.registerAdmin(adminMux)
+		s.adminSrv = &http.Server{Handler: adminMux}
+	}
 
 	// 2. Auto-compile missing .wasm files
 	if entries, err := os.ReadDir(filepath.Join(s.appRootDir, s.modulesDir)); err == nil {
@@ -167,10 +335,11 @@ func (s *WasiServer) StartServer(wg *sync.WaitGroup) {
 			if err == nil {
 				name := filepath.Base(file)
 				name = name[:len(name)-len(filepath.Ext(name))]
-				s.swapModule(name, bytes)
+				s.swapModuleFrom(name, bytes, file)
 			}
 		}
 	}
+	s.ready.Store(true)
 
 	// 3. Start fsnotify watcher on wasmDir
 	// Only start if externalWatcher is NOT enabled (default false)
@@ -214,53 +383,121 @@ func (s *WasiServer) StartServer(wg *sync.WaitGroup) {
 		}
 	}
 
-	// 4. http.ListenAndServe(port, mux) in goroutine
-	s.httpSrv = &http.Server{
-		Addr:    ":" + s.port,
-		Handler: s.mux,
+	// 4. Listen, then serve mux in goroutine, over TLS if configured.
+	// Listening here makes Addr() valid once StartServer returns.
+	s.httpSrv = &http.Server{Handler: s.mux}
+	tlsConfig, err := s.serverTLSConfig()
+	var l net.Listener
+	if err == nil {
+		l, err = s.listen()
+	}
+	if err != nil {
+		s.logger("HTTP server error: ", err)
+	} else {
+		s.mu.Lock()
+		s.addr = l.Addr()
+		s.mu.Unlock()
+		s.httpSrv.Addr = l.Addr().String()
+		s.httpSrv.TLSConfig = tlsConfig
+		go s.serve(s.httpSrv, l, "HTTP server error: ")
+
+		if s.adminSrv != nil {
+			s.adminSrv.TLSConfig = tlsConfig.Clone()
+			if al, err := listenOn(s.adminAddr(l.Addr())); err != nil {
+				s.logger("Admin server error: ", err)
+			} else {
+				s.adminSrv.Addr = al.Addr().String()
+				go s.serve(s.adminSrv, al, "Admin server error: ")
+			}
+		}
 	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-
-		go func() {
-			if err := s.httpSrv.ListenAndServe(); err != http.ErrServerClosed {
-				s.logger("HTTP server error: ", err)
-			}
-		}()
-
 		<-s.exitChan
 		s.StopServer()
 	}()
 }
 
+// serve runs srv on l until it is shut down, over TLS when srv.TLSConfig is set.
+func (s *WasiServer) serve(srv *http.Server, l net.Listener, errPrefix string) {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		s.logger(errPrefix, err)
+	}
+}
+
+// StopServer shuts the server down without a deadline; see StopServerContext.
 func (s *WasiServer) StopServer() error {
+	return s.StopServerContext(context.Background())
+}
+
+// StopServerContext shuts the server down within ctx. It stops accepting
+// connections, waits for in-flight requests, closes WebSocket clients with a
+// close frame, then drains and closes every module in parallel. Modules still
+// draining when ctx is done are closed anyway.
+func (s *WasiServer) StopServerContext(ctx context.Context) error {
+	s.ready.Store(false)
+
 	// 1. Stop watcher
 	if s.watcher != nil {
 		s.watcher.Close()
 	}
 
-	// 2. For each module: Drain(ctx, drainTimeout) → Close(ctx)
-	ctx := context.Background()
+	// 2. Stop accepting connections and wait for in-flight requests
+	var errs []error
+	if s.adminSrv != nil {
+		errs = append(errs, s.adminSrv.Shutdown(ctx))
+	}
+	if s.httpSrv != nil {
+		errs = append(errs, s.httpSrv.Shutdown(ctx))
+	}
 
+	// 3. WebSocket connections are hijacked, so Shutdown does not wait for them
+	errs = append(errs, s.hub().closeAll(ctx))
+
+	// 4. For each module, in parallel: Drain(ctx, drainTimeout) → Close(ctx)
 	s.mu.RLock()
-	mods := make([]*Module, 0, len(s.modules))
+	mods := make([]*Module, 0, len(s.modules)+len(s.canaries))
 	for _, mod := range s.modules {
 		mods = append(mods, mod)
 	}
+	for _, c := range s.canaries {
+		mods = append(mods, c.mod)
+	}
 	s.mu.RUnlock()
+	s.muMw.RLock()
+	for _, mw := range s.middlewares {
+		mods = append(mods, mw.Module)
+	}
+	s.muMw.RUnlock()
 
+	var wg sync.WaitGroup
 	for _, mod := range mods {
-		mod.Drain(ctx, s.drainTimeout)
-		mod.Close(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mod.holdSubscriptions()
+			s.drain(ctx, mod)
+			mod.Close(context.Background())
+		}()
 	}
+	wg.Wait()
 
-	// 3. httpSrv.Shutdown(ctx)
-	if s.httpSrv != nil {
-		return s.httpSrv.Shutdown(ctx)
+	s.muCache.Lock()
+	if s.cache != nil {
+		s.cache.Close(context.Background())
+		s.cache = nil
 	}
-	return nil
+	s.muCache.Unlock()
+
+	return errors.Join(errs...)
 }
 
 func (s *WasiServer) RestartServer() error {
@@ -274,7 +511,7 @@ func (s *WasiServer) RestartServer() error {
 		if err == nil {
 			name := filepath.Base(file)
 			name = name[:len(name)-len(filepath.Ext(name))]
-			s.swapModule(name, bytes)
+			s.swapModuleFrom(name, bytes, file)
 		}
 	}
 	return nil
@@ -319,7 +556,7 @@ func (s *WasiServer) NewFileEvent(fileName, extension, filePath, event string) e
 			return err
 		}
 		s.logger("Hot-reloading WASM:", name)
-		return s.swapModule(name, bytes)
+		return s.swapModuleFrom(name, bytes, filePath)
 	}
 
 	// 3. Handle GO files (Compilation)
@@ -408,37 +645,82 @@ func (s *WasiServer) MainInputFileRelativePath() string { return "" }
 
 // swapModule loads a new module, initializes it, then replaces the old one.
 func (s *WasiServer) swapModule(name string, wasmBytes []byte) error {
-	// 1. Load (outside lock)
-	ctx := context.Background()
-	if s.wsHub == nil {
-		s.mu.Lock()
-		if s.wsHub == nil {
-			s.wsHub = &wsHub{
-				clients: make(map[string]map[*wsConn]bool),
-				bus:     s.bus,
-			}
-		}
-		s.mu.Unlock()
-	}
+	return s.swapModuleFrom(name, wasmBytes, "")
+}
 
-	hb := NewHostBuilder(s.bus, s.wsHub.Broadcast, s.logger)
-	newMod, err := Load(ctx, name, wasmBytes, hb)
-	if err != nil {
-		s.logger("Load module error:", err)
-		return err
-	}
+// swapModuleFrom is swapModule for bytes read from source, which is recorded
+// in the module's version history.
+func (s *WasiServer) swapModuleFrom(name string, wasmBytes []byte, source string) error {
+	return s.installModule(name, wasmBytes, source, nil)
+}
 
-	// 2. Init (outside lock)
-	if err := newMod.Init(ctx); err != nil {
-		s.logger("Init module error:", err)
-		newMod.Close(ctx)
+// swapLock returns the mutex that serializes swaps, rollbacks and canary
+// changes of module name, so two of them never migrate, drain or close the
+// same module at once.
+func (s *WasiServer) swapLock(name string) *sync.Mutex {
+	l, _ := s.swapLocks.LoadOrStore(name, new(sync.Mutex))
+	return l.(*sync.Mutex)
+}
+
+// installModule does the work of swapModule under the module's swap lock.
+func (s *WasiServer) installModule(name string, wasmBytes []byte, source string, reinstate *version) error {
+	l := s.swapLock(name)
+	l.Lock()
+	defer l.Unlock()
+	return s.installModuleLocked(name, wasmBytes, source, reinstate)
+}
+
+// installModuleLocked swaps in wasmBytes as module name; the caller holds its
+// swap lock. Reinstating a recorded version (a rollback) skips state
+// migration, since the failing module's state is suspect, and is not watched
+// for errors.
+func (s *WasiServer) installModuleLocked(name string, wasmBytes []byte, source string, reinstate *version) (err error) {
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		s.metrics.add("wasi_swaps_total", 1, name, result)
+	}()
+	rollback := reinstate != nil
+	// 1-2. Load and init (outside lock)
+	ctx := context.Background()
+	newMod, err := s.loadModule(ctx, name, wasmBytes, false)
+	if err != nil {
 		return err
 	}
 
-	// 3. Swap (inside lock)
 	// Check if it's a middleware
 	rule, isMiddleware := loadRuleFromSourceDir(filepath.Join(s.appRootDir, s.modulesDir), name)
 
+	// 3. Migrate state (outside lock): hold new calls to the running module so
+	// nothing it does after its snapshot is lost, drain it, then move its
+	// snapshot() into the new module's restore(). Held calls go to the new
+	// module once it is swapped in; on failure the old module stays and
+	// serves them.
+	var held *Module
+	current := s.loadedModule(name, isMiddleware)
+	if !rollback && current != nil && current.migrates(newMod) {
+		held = current
+		hctx := current.hold(ctx)
+		s.drain(hctx, current)
+		if n := current.pool.size(); n > 1 {
+			s.logger("State migration warning:", name, "has", n, "instances; only one instance's snapshot is carried over")
+		}
+
+		state, err := current.Snapshot(hctx)
+		if err == nil {
+			err = newMod.Restore(ctx, state)
+		}
+		if err != nil {
+			current.release(nil)
+			s.logger("State migration error, keeping old module:", err)
+			newMod.Close(ctx)
+			return err
+		}
+	}
+
+	// 4. Swap (inside lock)
 	var oldMod *Module
 	if isMiddleware {
 		s.muMw.Lock()
@@ -462,16 +744,177 @@ func (s *WasiServer) swapModule(name string, wasmBytes []byte) error {
 		s.modules[name] = newMod
 		s.mu.Unlock()
 	}
+	s.mu.Lock()
+	prev := s.recordVersionLocked(name, wasmBytes, source, reinstate)
+	s.mu.Unlock()
+	if held != nil {
+		held.release(newMod)
+	}
 
-	// 4. Drain Old (outside lock)
+	// 5. Retire Old (outside lock), unless it was drained for migration
 	if oldMod != nil {
-		oldMod.Drain(ctx, s.drainTimeout)
-		oldMod.Close(ctx)
+		if oldMod == held {
+			oldMod.Close(ctx)
+		} else {
+			s.retire(ctx, oldMod)
+		}
+	}
+
+	if !rollback {
+		s.watchSwap(name, newMod, prev)
+	}
+	return nil
+}
+
+var ErrModuleNotLoaded = errors.New("wasi: module not loaded")
+
+// UnloadModule stops serving module name, along with its canary, then drains
+// and closes it. Its version history is kept, so Rollback can load it again.
+func (s *WasiServer) UnloadModule(name string) error {
+	var mods []*Module
+	s.mu.Lock()
+	if mod := s.modules[name]; mod != nil {
+		mods = append(mods, mod)
+		delete(s.modules, name)
+	}
+	if c := s.canaries[name]; c != nil {
+		mods = append(mods, c.mod)
+		delete(s.canaries, name)
 	}
+	s.mu.Unlock()
 
+	s.muMw.Lock()
+	for i, mw := range s.middlewares {
+		if mw.Module.name == name {
+			mods = append(mods, mw.Module)
+			s.middlewares = append(s.middlewares[:i], s.middlewares[i+1:]...)
+			break
+		}
+	}
+	s.muMw.Unlock()
+
+	if len(mods) == 0 {
+		return ErrModuleNotLoaded
+	}
+	ctx := context.Background()
+	for _, mod := range mods {
+		s.retire(ctx, mod)
+	}
+	s.logger("Unloaded module:", name)
 	return nil
 }
 
+// retire takes mod, which no longer serves requests, off the bus so steady
+// traffic cannot keep its drain running, then drains and closes it.
+func (s *WasiServer) retire(ctx context.Context, mod *Module) {
+	mod.holdSubscriptions()
+	s.drain(ctx, mod)
+	mod.Close(ctx)
+}
+
+// drain drains mod before it is closed and records how long that took.
+func (s *WasiServer) drain(ctx context.Context, mod *Module) {
+	start := time.Now()
+	if err := mod.Drain(ctx, s.drainTimeout); err != nil {
+		s.logger("Drain warning:", err)
+	}
+	s.metrics.observe("wasi_drain_duration_seconds", time.Since(start).Seconds(), mod.name)
+}
+
+// loadModule compiles and initializes wasmBytes as module name with its
+// manifest and limits. An unreadable manifest refuses the load. A canary's
+// subscriptions are held off the bus.
+func (s *WasiServer) loadModule(ctx context.Context, name string, wasmBytes []byte, canary bool) (*Module, error) {
+	mf, err := loadManifestFromSourceDir(filepath.Join(s.appRootDir, s.modulesDir), name)
+	if err != nil {
+		s.logger("Manifest error:", err)
+		return nil, err
+	}
+	hb := NewHostBuilder(s.bus, s.hub().Broadcast, s.logger).SetKVStore(s.kv).SetManifest(mf).SetMetrics(s.metrics)
+	mod, err := LoadWithConfig(ctx, name, wasmBytes, hb, s.loadConfig(name, mf))
+	if err != nil {
+		s.logger("Load module error:", err)
+		return nil, err
+	}
+	if canary {
+		mod.holdSubscriptions()
+	}
+	if err := mod.Init(ctx); err != nil {
+		s.logger("Init module error:", err)
+		mod.Close(ctx)
+		return nil, err
+	}
+	return mod, nil
+}
+
+// hub returns the WebSocket hub, creating it on first use.
+func (s *WasiServer) hub() *wsHub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wsHub == nil {
+		s.wsHub = &wsHub{
+			clients:       make(map[string]map[*wsConn]bool),
+			bus:           s.bus,
+			inboundPrefix: s.wsInboundPrefix,
+			metrics:       s.metrics,
+		}
+	}
+	return s.wsHub
+}
+
+// loadedModule returns the module currently serving name, or nil.
+func (s *WasiServer) loadedModule(name string, isMiddleware bool) *Module {
+	if isMiddleware {
+		s.muMw.RLock()
+		defer s.muMw.RUnlock()
+		for _, mw := range s.middlewares {
+			if mw.Module.name == name {
+				return mw.Module
+			}
+		}
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.modules[name]
+}
+
+// loadConfig returns the LoadConfig applied to module name. Limits come from
+// SetModuleLimits, else SetLimits; the manifest can only tighten them.
+func (s *WasiServer) loadConfig(name string, mf *Manifest) LoadConfig {
+	limits, ok := s.moduleLimits[name]
+	if !ok {
+		limits = s.limits
+	}
+	if mf != nil && mf.Limits != nil {
+		limits = limits.tighten(mf.Limits.limits())
+	}
+	return LoadConfig{
+		PoolMin: s.poolMin,
+		PoolMax: s.poolMax,
+		Limits:  limits,
+		Cache:   s.compilationCache(),
+		Restart: s.restart,
+		Logger:  s.logger,
+	}
+}
+
+// compilationCache opens the cache configured by SetCompilationCacheDir on first use.
+func (s *WasiServer) compilationCache() *CompilationCache {
+	s.muCache.Lock()
+	defer s.muCache.Unlock()
+	if s.cache == nil && s.cacheDir != "" {
+		cache, err := NewCompilationCache(s.cacheDir)
+		if err != nil {
+			s.logger("Compilation cache disabled:", err)
+			s.cacheDir = ""
+			return nil
+		}
+		s.cache = cache
+	}
+	return s.cache
+}
+
 func (s *WasiServer) handleMiddlewareDispatch(w http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, "/m/")
 	if name == "" {
@@ -482,83 +925,100 @@ func (s *WasiServer) handleMiddlewareDispatch(w http.ResponseWriter, r *http.Req
 		name = name[:idx]
 	}
 
-	ctx := r.Context()
-	reqBody := r.Method + "\n" + r.URL.Path + "\n"
-
-	// Helper to call handle on a module
-	callHandle := func(m *Module) (uint32, error) {
-		if m.handleFn == nil {
-			return 0, nil
-		}
-
-		// Allocate memory for request
-		malloc := m.mod.ExportedFunction("malloc")
-		var ptr uint32
-		if malloc != nil {
-			res, err := malloc.Call(ctx, uint64(len(reqBody)))
-			if err == nil && len(res) > 0 {
-				ptr = uint32(res[0])
-				m.mod.Memory().Write(ptr, []byte(reqBody))
-			}
-		}
-
-		return m.Handle(ctx, ptr, uint32(len(reqBody)))
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
 	}
 
+	ctx := r.Context()
+	req := newRequest(r, body)
+
 	// 1. Pipeline
 	s.muMw.RLock()
 	pipeline := applyPipeline(name, s.middlewares)
 	s.muMw.RUnlock()
 
-	var resultPtr uint32
-	var targetMod *Module
+	// Only requests for a loaded module are counted, so arbitrary paths
+	// cannot grow the metric label set.
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	w = sw
+	counted := s.loadedModule(name, false) != nil
+	defer func() {
+		if counted {
+			s.metrics.add("wasi_requests_total", 1, name, strconv.Itoa(sw.code))
+			s.metrics.observe("wasi_request_duration_seconds", time.Since(start).Seconds(), name)
+		}
+	}()
+
+	var resp *Response
 
 	for _, mw := range pipeline {
-		ptr, err := callHandle(mw.Module)
+		out, err := mw.Module.Handle(ctx, req)
 		if err != nil {
+			s.metrics.add("wasi_module_errors_total", 1, mw.Module.name, errorKind(err))
 			s.logger("Middleware error:", err)
 			continue
 		}
-		if ptr != 0 {
-			resultPtr = ptr
-			targetMod = mw.Module
+		if out != nil {
+			resp = out
 			break
 		}
 	}
 
-	// 2. Target Module
-	if resultPtr == 0 {
-		s.mu.RLock()
-		mod := s.modules[name]
-		s.mu.RUnlock()
+	// 2. Target Module (or its canary)
+	if resp == nil {
+		mod := s.targetModule(name, r)
 
 		if mod == nil {
 			http.NotFound(w, r)
 			return
 		}
 
-		ptr, err := callHandle(mod)
+		out, err := mod.Handle(ctx, req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.metrics.add("wasi_module_errors_total", 1, name, errorKind(err))
+			http.Error(w, err.Error(), statusForError(err))
 			return
 		}
-		resultPtr = ptr
-		targetMod = mod
+		resp = out
 	}
 
 	// 3. Response
-	if resultPtr != 0 && targetMod != nil {
-		mem := targetMod.mod.Memory()
-		buf := make([]byte, 0, 1024)
-		for i := uint32(0); i < 65536; i++ {
-			b, ok := mem.ReadByte(resultPtr + i)
-			if !ok || b == 0 {
-				break
-			}
-			buf = append(buf, b)
-		}
-		w.Write(buf)
-	} else {
+	if resp == nil {
 		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// statusWriter records the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// statusForError maps a module call error to an HTTP status.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrCallTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrMemoryLimit), errors.Is(err, ErrModuleUnhealthy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errEnvelope):
+		return http.StatusBadGateway
 	}
+	return http.StatusInternalServerError
 }
@@ -2,6 +2,9 @@ package wasi
 
 import (
 	"context"
+	encbinary "encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -16,6 +19,7 @@ import (
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tinywasm/binary"
 	"github.com/tinywasm/bus"
+	tfmt "github.com/tinywasm/fmt"
 	"nhooyr.io/websocket"
 )
 
@@ -47,6 +51,64 @@ func TestWasiServer_StartStop(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWasiServer_StopServerContext(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tmp := t.TempDir()
+	srv := New().SetPort(fmt.Sprintf("%d", port)).SetAppRootDir(tmp).SetOutputDir(tmp)
+	var wg sync.WaitGroup
+	srv.StartServer(&wg)
+	waitForPort(t, port)
+	if err := srv.swapModule("slow", slowHandleWasm(300)); err != nil {
+		t.Fatal(err)
+	}
+	mod := srv.loadedModule("slow", false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://localhost:%d/ws?topic=t", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan websocket.StatusCode, 1)
+	go func() {
+		_, _, err := ws.Read(ctx)
+		closed <- websocket.CloseStatus(err)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/m/slow", port))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	for mod.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := srv.StopServerContext(ctx); err != nil {
+		t.Fatalf("StopServerContext = %v", err)
+	}
+	if got := <-status; got != http.StatusNoContent {
+		t.Errorf("in-flight request answered %d, want 204", got)
+	}
+	if got := <-closed; got != websocket.StatusGoingAway {
+		t.Errorf("WebSocket closed with %v, want StatusGoingAway", got)
+	}
+	if _, err := mod.Handle(context.Background(), &Request{}); err == nil {
+		t.Error("module not closed after shutdown")
+	}
+}
+
 func TestWasiServer_SwapModule_Lifecycle(t *testing.T) {
 	srv := New()
 	// Use temp dir
@@ -98,11 +160,27 @@ func (m *mockMemory) Write(offset uint32, v []byte) bool {
 	return true
 }
 
+func (m *mockMemory) WriteUint32Le(offset, v uint32) bool {
+	return m.Write(offset, encbinary.LittleEndian.AppendUint32(nil, v))
+}
+
 type mockFunction struct {
 	api.Function
+	params []api.ValueType
 	callFn func(ctx context.Context, params ...uint64) ([]uint64, error)
 }
 
+func (f *mockFunction) Definition() api.FunctionDefinition {
+	return &mockFunctionDefinition{params: f.params}
+}
+
+type mockFunctionDefinition struct {
+	api.FunctionDefinition
+	params []api.ValueType
+}
+
+func (d *mockFunctionDefinition) ParamTypes() []api.ValueType { return d.params }
+
 func (f *mockFunction) Call(ctx context.Context, params ...uint64) ([]uint64, error) {
 	if f.callFn != nil {
 		return f.callFn(ctx, params...)
@@ -120,6 +198,10 @@ func (m *mockModule) Memory() api.Memory {
 	return m.mem
 }
 
+func (m *mockModule) IsClosed() bool {
+	return false
+}
+
 func (m *mockModule) ExportedFunction(name string) api.Function {
 	return m.exports[name]
 }
@@ -231,18 +313,22 @@ func TestHostBuilder_Subscribe(t *testing.T) {
 		},
 	}
 
-	// Setup context with Module
-	realMod := &Module{
-		cleanups: []func(){},
-	}
+	// Setup context with Module; messages are delivered through its pool
+	realMod := newMockBackedModule(mod)
 	ctx := context.WithValue(context.Background(), moduleKey{}, realMod)
 
 	// Call subscribe
-	hb.subscribe(ctx, mod, 0, 9, 0)
+	id := hb.subscribe(ctx, mod, 0, 9, 0)
+	if id == 0 {
+		t.Fatal("subscribe returned no ID")
+	}
 
-	// Verify cleanup registered
-	if len(realMod.cleanups) != 1 {
-		t.Error("Cleanup not registered")
+	// Verify the subscription is tracked
+	if subs := realMod.Subscriptions(); len(subs) != 1 || subs[0] != (Subscription{ID: id, Topic: "sub-topic"}) {
+		t.Errorf("Subscriptions() = %+v", subs)
+	}
+	if again := hb.subscribe(ctx, mod, 0, 9, 0); again != id {
+		t.Errorf("second subscribe = %d, want shared ID %d", again, id)
 	}
 
 	// Publish message to bus
@@ -255,8 +341,16 @@ func TestHostBuilder_Subscribe(t *testing.T) {
 		t.Error("on_message not called")
 	}
 
-	// Verify cleanup works (unsubscribe)
-	realMod.cleanups[0]()
+	// Unsubscribe
+	if got := hb.unsubscribe(ctx, mod, id); got != StatusOK {
+		t.Errorf("unsubscribe = %d, want StatusOK", got)
+	}
+	if got := hb.unsubscribe(ctx, mod, id); got != StatusNotFound {
+		t.Errorf("second unsubscribe = %d, want StatusNotFound", got)
+	}
+	if subs := realMod.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Subscriptions() after unsubscribe = %+v", subs)
+	}
 
 	// Publish again, should not call on_message
 	onMessageCalled.Store(false)
@@ -267,6 +361,289 @@ func TestHostBuilder_Subscribe(t *testing.T) {
 	}
 }
 
+// TestHostBuilder_BaselineVoidImports loads a module built against the original
+// ABI, in which publish, subscribe and ws_broadcast return nothing.
+func TestHostBuilder_BaselineVoidImports(t *testing.T) {
+	f := &wasmFixture{}
+	pubFn := f.imp("publish", []byte{i32, i32, i32, i32}, nil)
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, nil)
+	wsFn := f.imp("ws_broadcast", []byte{i32, i32, i32, i32}, nil)
+	f.memory(1).dataAt(0, []byte("in")).dataAt(8, []byte("out"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil, ops(
+		i32Const(8), i32Const(3), localGet(0), localGet(1), call(pubFn),
+		i32Const(8), i32Const(3), localGet(0), localGet(1), call(wsFn),
+	)...)
+	f.fn("init", nil, nil, nil, ops(i32Const(0), i32Const(2), i32Const(0), call(subFn))...)
+
+	b := bus.New()
+	out := make(chan string, 1)
+	b.Subscribe("out", func(msg binary.Message) { out <- string(msg.Payload) })
+	broadcast := make(chan string, 1)
+	hb := NewHostBuilder(b, func(topic string, msg []byte) { broadcast <- topic + ":" + string(msg) }, nil)
+
+	ctx := context.Background()
+	mod, err := Load(ctx, "legacy", f.bytes(), hb)
+	if err != nil {
+		t.Fatalf("Load of a baseline-ABI module: %v", err)
+	}
+	defer mod.Close(ctx)
+	if err := mod.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Publish("in", binary.Message{Payload: []byte("ping")})
+	for name, ch := range map[string]chan string{"publish": out, "ws_broadcast": broadcast} {
+		select {
+		case got := <-ch:
+			if got != "ping" && got != "out:ping" {
+				t.Errorf("%s carried %q", name, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("void %s had no effect", name)
+		}
+	}
+}
+
+// echoResponderWasm subscribes to "auth.check" and replies to each request with its payload.
+func echoResponderWasm() []byte {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	replyFn := f.imp("reply", []byte{i32, i32, i32}, []byte{i32})
+	idFn := f.imp("message_id", nil, []byte{i32})
+	f.memory(1).dataAt(0, []byte("auth.check"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil, ops(
+		call(idFn), localGet(0), localGet(1), call(replyFn), drop(),
+	)...)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(10), i32Const(0), call(subFn), drop(),
+	)...)
+	return f.bytes()
+}
+
+func TestHostBuilder_RequestReply(t *testing.T) {
+	b := bus.New()
+	ctx := context.Background()
+	responder, err := Load(ctx, "auth", echoResponderWasm(), NewHostBuilder(b, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close(ctx)
+	if err := responder.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The requester is a mock: "auth.check" at 0, payload at 16, out params at 32/36,
+	// and malloc places the reply at 100.
+	mem := &mockMemory{data: make([]byte, 1024)}
+	copy(mem.data[0:], "auth.check")
+	copy(mem.data[16:], "token-1")
+	mod := &mockModule{mem: mem, exports: map[string]api.Function{
+		"malloc": &mockFunction{callFn: func(ctx context.Context, params ...uint64) ([]uint64, error) {
+			return []uint64{100}, nil
+		}},
+	}}
+	hb := NewHostBuilder(b, nil, nil)
+
+	if got := hb.request(ctx, mod, 0, 10, 16, 7, 1000, 32, 36); got != StatusOK {
+		t.Fatalf("request = %d, want StatusOK", got)
+	}
+	ptr, n := encbinary.LittleEndian.Uint32(mem.data[32:]), encbinary.LittleEndian.Uint32(mem.data[36:])
+	if string(mem.data[ptr:ptr+n]) != "token-1" {
+		t.Errorf("reply = %q, want %q", mem.data[ptr:ptr+n], "token-1")
+	}
+
+	copy(mem.data[0:], "nobody.here")
+	if got := hb.request(ctx, mod, 0, 11, 16, 7, 20, 32, 36); got != StatusTimeout {
+		t.Errorf("request without responder = %d, want StatusTimeout", got)
+	}
+	if got := hb.messageID(ctx); got != 0 {
+		t.Errorf("messageID outside on_message = %d, want 0", got)
+	}
+}
+
+func TestHostBuilder_ReplyTopicReserved(t *testing.T) {
+	b := bus.New()
+	forged := make(chan binary.Message, 2)
+	b.Subscribe(replyTopic(7), func(msg binary.Message) { forged <- msg })
+
+	topic := replyTopic(7)
+	var encoded []byte
+	if err := binary.Encode(&binary.Message{Topic: topic, ID: 7, Payload: []byte("yes")}, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	mem := &mockMemory{data: make([]byte, 1024)}
+	copy(mem.data, topic)
+	copy(mem.data[100:], encoded)
+	mod := &mockModule{mem: mem}
+	hb := NewHostBuilder(b, nil, nil)
+	ctx := context.Background()
+
+	if got := hb.publish(ctx, mod, 0, uint32(len(topic)), 100, 3); got != StatusDenied {
+		t.Errorf("publish to %s = %d, want StatusDenied", topic, got)
+	}
+	if got := hb.publishEnvelope(ctx, mod, 100, uint32(len(encoded))); got != StatusDenied {
+		t.Errorf("publish_envelope to %s = %d, want StatusDenied", topic, got)
+	}
+	if got := hb.request(ctx, mod, 0, uint32(len(topic)), 100, 3, 10, 200, 204); got != StatusDenied {
+		t.Errorf("request to %s = %d, want StatusDenied", topic, got)
+	}
+	if got := hb.subscribe(ctx, mod, 0, uint32(len(topic)), 0); got != 0 {
+		t.Errorf("subscribe to %s = %d, want 0", topic, got)
+	}
+	select {
+	case msg := <-forged:
+		t.Errorf("forged reply reached the requester: %+v", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestHostBuilder_ReplyOnlyByRecipient(t *testing.T) {
+	b := bus.New()
+	ctx := context.Background()
+
+	// The requester is a mock waiting on "nobody.here"; malloc places a reply at 100.
+	mem := &mockMemory{data: make([]byte, 1024)}
+	copy(mem.data[0:], "nobody.here")
+	requester := &mockModule{mem: mem, exports: map[string]api.Function{
+		"malloc": &mockFunction{callFn: func(ctx context.Context, params ...uint64) ([]uint64, error) {
+			return []uint64{100}, nil
+		}},
+	}}
+	hb := NewHostBuilder(b, nil, nil)
+	done := make(chan uint32, 1)
+	go func() { done <- hb.request(ctx, requester, 0, 11, 0, 0, 200, 32, 36) }()
+
+	// Wait until the request is pending, then guess its correlation ID.
+	var id uint32
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		pending.Lock()
+		for pid := range pending.requests {
+			id = pid
+		}
+		pending.Unlock()
+		if id != 0 {
+			break
+		}
+	}
+	if id == 0 {
+		t.Fatal("request never became pending")
+	}
+	forger := &mockModule{mem: &mockMemory{data: make([]byte, 64)}}
+	fctx := context.WithValue(ctx, moduleKey{}, newMockBackedModule(forger))
+	if got := hb.reply(fctx, forger, id, 0, 4); got != StatusNotFound {
+		t.Errorf("reply to a request never delivered = %d, want StatusNotFound", got)
+	}
+	if got := <-done; got != StatusTimeout {
+		t.Errorf("request answered by a module it was not sent to: status %d", got)
+	}
+}
+
+func TestHostBuilder_MessageTypes(t *testing.T) {
+	b := bus.New()
+	types := make(chan tfmt.MessageType, 3)
+	record := func(msg binary.Message) { types <- msg.Type }
+	b.Subscribe("events", record)
+	b.Subscribe("jobs", record)
+
+	mem := &mockMemory{data: make([]byte, 64)}
+	copy(mem.data[0:], "events")
+	copy(mem.data[8:], "jobs")
+	mod := &mockModule{mem: mem}
+	realMod := newMockBackedModule(mod)
+	ctx := context.WithValue(context.Background(), moduleKey{}, realMod)
+	hb := NewHostBuilder(b, nil, nil)
+
+	hb.publish(ctx, mod, 0, 6, 0, 0)
+	hb.request(ctx, mod, 8, 4, 0, 0, 1, 32, 36)
+	const id = 1 << 31
+	openRequest(id)
+	defer closeRequest(id)
+	requestDelivered(id, realMod)
+	b.Subscribe(replyTopic(id), record)
+	if got := hb.reply(ctx, mod, id, 0, 0); got != StatusOK {
+		t.Fatalf("reply = %d", got)
+	}
+
+	want := map[tfmt.MessageType]bool{tfmt.Msg.Event: true, tfmt.Msg.Request: true, tfmt.Msg.Response: true}
+	for i := 0; i < 3; i++ {
+		select {
+		case typ := <-types:
+			if !want[typ] {
+				t.Errorf("unexpected message type %d", typ)
+			}
+			delete(want, typ)
+		case <-time.After(time.Second):
+			t.Fatalf("message types not seen: %v", want)
+		}
+	}
+}
+
+func TestHostBuilder_Envelope(t *testing.T) {
+	b := bus.New()
+	received := make(chan binary.Message, 1)
+	b.Subscribe("users.created", func(msg binary.Message) { received <- msg })
+
+	sent := binary.Message{Topic: "users.created", Type: tfmt.Msg.Event, ID: 42, Payload: []byte("alice")}
+	var encoded []byte
+	if err := binary.Encode(&sent, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	mem := &mockMemory{data: make([]byte, 1024)}
+	copy(mem.data, encoded)
+
+	// on_envelope records the message it is handed.
+	var delivered []byte
+	var handler uint64
+	mod := &mockModule{mem: mem, exports: map[string]api.Function{
+		"malloc": &mockFunction{callFn: func(ctx context.Context, params ...uint64) ([]uint64, error) {
+			return []uint64{512}, nil
+		}},
+		"on_envelope": &mockFunction{callFn: func(ctx context.Context, params ...uint64) ([]uint64, error) {
+			delivered = append([]byte(nil), mem.data[params[0]:params[0]+params[1]]...)
+			handler = params[2]
+			return nil, nil
+		}},
+	}}
+	realMod := newMockBackedModule(mod)
+	ctx := context.WithValue(context.Background(), moduleKey{}, realMod)
+	hb := NewHostBuilder(b, nil, nil)
+
+	if got := hb.publishEnvelope(ctx, mod, 0, uint32(len(encoded))); got != StatusOK {
+		t.Fatalf("publish_envelope = %d, want StatusOK", got)
+	}
+	select {
+	case msg := <-received:
+		// The guest-set ID is cleared: only request assigns correlation IDs.
+		if msg.Topic != sent.Topic || msg.Type != sent.Type || msg.ID != 0 || string(msg.Payload) != "alice" {
+			t.Errorf("bus received %+v, want %+v without its ID", msg, sent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish_envelope did not reach the bus")
+	}
+
+	if err := realMod.deliver(context.Background(), nil, sent.Topic, 3, sent); err != nil {
+		t.Fatal(err)
+	}
+	var got binary.Message
+	if err := binary.Decode(delivered, &got); err != nil || got.ID != 42 || got.Type != tfmt.Msg.Event || handler != 3 {
+		t.Errorf("on_envelope got %+v (handler %d, err %v)", got, handler, err)
+	}
+
+	// Host-side publishers may leave Topic empty; the guest routes by it.
+	if err := realMod.deliver(context.Background(), nil, "users.created", 3, binary.Message{Payload: []byte("bob")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Decode(delivered, &got); err != nil || got.Topic != "users.created" {
+		t.Errorf("on_envelope got topic %q, want %q (err %v)", got.Topic, "users.created", err)
+	}
+
+	if got := hb.publishEnvelope(ctx, mod, 900, 3); got != StatusError {
+		t.Errorf("publish_envelope with garbage = %d, want StatusError", got)
+	}
+}
+
 func TestWsHub(t *testing.T) {
 	// Setup hub
 	b := bus.New()
@@ -306,6 +683,17 @@ func TestWsHub(t *testing.T) {
 }
 
 // Helpers
+
+// newMockBackedModule wraps mod in a single-instance pool.
+func newMockBackedModule(mod api.Module) *Module {
+	m := &Module{}
+	m.pool = newInstancePool(1, func(ctx context.Context) (*instance, error) {
+		return newInstance(mod), nil
+	})
+	m.pool.fill(context.Background(), 1)
+	return m
+}
+
 func waitForPort(t *testing.T, port int) {
 	timeout := time.After(5 * time.Second)
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -373,3 +761,481 @@ func TestWasiServer_RestartServer(t *testing.T) {
 		t.Error("Module not loaded after restart")
 	}
 }
+
+// snapshotWasm exports snapshot(), returning state stored at offset 100.
+func snapshotWasm(state string) []byte {
+	f := &wasmFixture{}
+	f.memory(1).dataAt(100, []byte(state))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("snapshot", nil, []byte{i64}, nil, i64Const(100<<32|int64(len(state)))...)
+	return f.bytes()
+}
+
+// restoreWasm exports restore(ptr, len), which logs the state it receives and returns status.
+func restoreWasm(status int32) []byte {
+	f := &wasmFixture{}
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("restore", []byte{i32, i32}, []byte{i32}, nil, ops(
+		localGet(0), localGet(1), call(logFn),
+		i32Const(status),
+	)...)
+	return f.bytes()
+}
+
+func TestWasiServer_SwapModule_MigratesState(t *testing.T) {
+	var logged []string
+	srv := New().SetLogger(func(msg ...any) {
+		if len(msg) == 2 && msg[0] == "[WASI]" {
+			logged = append(logged, msg[1].(string))
+		}
+	})
+
+	if err := srv.swapModule("counter", snapshotWasm("count=7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.swapModule("counter", restoreWasm(0)); err != nil {
+		t.Fatalf("swap with restore failed: %v", err)
+	}
+	if len(logged) != 1 || logged[0] != "count=7" {
+		t.Errorf("restore received %q, want [count=7]", logged)
+	}
+}
+
+func TestWasiServer_SwapModule_WarnsOnPooledState(t *testing.T) {
+	var warned bool
+	srv := New().SetPoolSize(2, 2).SetLogger(func(msg ...any) {
+		if msg[0] == "State migration warning:" {
+			warned = true
+		}
+	})
+	if err := srv.swapModule("counter", snapshotWasm("count=7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.swapModule("counter", restoreWasm(0)); err != nil {
+		t.Fatal(err)
+	}
+	if !warned {
+		t.Error("no warning that state from one of two instances was migrated")
+	}
+}
+
+func TestWasiServer_SwapModule_RestoreFailureKeepsOld(t *testing.T) {
+	srv := New()
+	if err := srv.swapModule("counter", snapshotWasm("count=7")); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.RLock()
+	old := srv.modules["counter"]
+	srv.mu.RUnlock()
+
+	if err := srv.swapModule("counter", restoreWasm(1)); err == nil {
+		t.Fatal("swap succeeded although restore failed")
+	}
+
+	srv.mu.RLock()
+	current := srv.modules["counter"]
+	srv.mu.RUnlock()
+	if current != old {
+		t.Error("old module replaced after failed restore")
+	}
+	if _, err := current.Snapshot(context.Background()); err != nil {
+		t.Errorf("old module unusable after failed restore: %v", err)
+	}
+}
+
+// migratingWasm exports both snapshot, returning state, and restore, which logs what it receives.
+func migratingWasm(state string) []byte {
+	f := &wasmFixture{}
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	f.memory(1).dataAt(100, []byte(state))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("snapshot", nil, []byte{i64}, nil, i64Const(100<<32|int64(len(state)))...)
+	f.fn("restore", []byte{i32, i32}, []byte{i32}, nil, ops(
+		localGet(0), localGet(1), call(logFn),
+		i32Const(0),
+	)...)
+	return f.bytes()
+}
+
+func TestWasiServer_SwapModule_Serialized(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	srv := New().SetLogger(func(msg ...any) {
+		if len(msg) == 2 && msg[0] == "[WASI]" {
+			mu.Lock()
+			logged = append(logged, msg[1].(string))
+			mu.Unlock()
+		}
+	})
+	if err := srv.swapModule("counter", migratingWasm("v0")); err != nil {
+		t.Fatal(err)
+	}
+
+	const swaps = 8
+	var wg sync.WaitGroup
+	for i := 1; i <= swaps; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := srv.swapModule("counter", migratingWasm(fmt.Sprintf("v%d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Each swap migrated from the module the previous one installed, so
+	// every state but the last was restored exactly once.
+	seen := map[string]bool{}
+	for _, state := range logged {
+		if seen[state] {
+			t.Errorf("state %s restored twice", state)
+		}
+		seen[state] = true
+	}
+	if len(logged) != swaps {
+		t.Errorf("%d restores, want %d", len(logged), swaps)
+	}
+	versions := srv.Versions("counter")
+	if len(versions) != swaps+1 {
+		t.Fatalf("%d versions recorded, want %d", len(versions), swaps+1)
+	}
+	for i, v := range versions {
+		if v.Version != i+1 {
+			t.Errorf("versions[%d] = %d, want %d", i, v.Version, i+1)
+		}
+	}
+	if _, err := srv.loadedModule("counter", false).Snapshot(context.Background()); err != nil {
+		t.Errorf("current module unusable: %v", err)
+	}
+}
+
+func TestModule_HoldDuringSwap(t *testing.T) {
+	ctx := context.Background()
+	load := func(body string) *Module {
+		mod, err := Load(ctx, "users", staticHandleWasm(body), NewHostBuilder(bus.New(), nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mod.Close(ctx) })
+		return mod
+	}
+	old, next := load("old"), load("new")
+
+	hctx := old.hold(ctx)
+	served := make(chan string, 1)
+	go func() {
+		resp, err := old.Handle(ctx, &Request{Method: "GET"})
+		if err != nil {
+			served <- err.Error()
+			return
+		}
+		served <- string(resp.Body)
+	}()
+	select {
+	case got := <-served:
+		t.Fatalf("call served by %q while the module was held", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := old.Drain(hctx, time.Second); err != nil {
+		t.Errorf("Drain with a call held: %v", err)
+	}
+	if resp, err := old.Handle(hctx, &Request{Method: "GET"}); err != nil || string(resp.Body) != "old" {
+		t.Errorf("holder's own call = %v, %v", resp, err)
+	}
+
+	old.release(next)
+	if got := <-served; got != "new" {
+		t.Errorf("held call served by %q, want the replacement", got)
+	}
+}
+
+func TestModule_RestoreCallTimeout(t *testing.T) {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	// restore spins forever: loop { br 0 }
+	f.fn("restore", []byte{i32, i32}, []byte{i32}, nil, ops(
+		[]byte{0x03, 0x40, 0x0c, 0x00, 0x0b},
+		i32Const(0),
+	)...)
+
+	ctx := context.Background()
+	cfg := LoadConfig{Limits: Limits{CallTimeout: 50 * time.Millisecond}}
+	mod, err := LoadWithConfig(ctx, "spin", f.bytes(), NewHostBuilder(bus.New(), nil, nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+	if err := mod.Restore(ctx, []byte("state")); !errors.Is(err, ErrCallTimeout) {
+		t.Errorf("Restore = %v, want ErrCallTimeout", err)
+	}
+	if mod.active.Load() != 0 {
+		t.Errorf("active = %d after Restore", mod.active.Load())
+	}
+}
+
+// slowHandleWasm exports handle(), which blocks for ms in a request nobody answers.
+func slowHandleWasm(ms int32) []byte {
+	f := &wasmFixture{}
+	reqFn := f.imp("request", []byte{i32, i32, i32, i32, i32, i32, i32}, []byte{i32})
+	f.memory(1).dataAt(16, []byte("nobody"))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("handle", []byte{i32, i32}, []byte{i32}, nil, ops(
+		i32Const(16), i32Const(6), i32Const(0), i32Const(0), i32Const(ms), i32Const(64), i32Const(68),
+		call(reqFn), drop(),
+		i32Const(0),
+	)...)
+	return f.bytes()
+}
+
+func TestModule_DrainWaitsForInFlightCalls(t *testing.T) {
+	ctx := context.Background()
+	hb := NewHostBuilder(bus.New(), nil, func(...any) {})
+	mod, err := LoadWithConfig(ctx, "slow", slowHandleWasm(200), hb, LoadConfig{PoolMin: 1, PoolMax: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		mod.Handle(ctx, &Request{Method: "GET"})
+		close(done)
+	}()
+	for mod.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := mod.Drain(ctx, 20*time.Millisecond); !errors.Is(err, ErrDrainTimeout) {
+		t.Errorf("Drain with a call in flight = %v, want ErrDrainTimeout", err)
+	}
+	start := time.Now()
+	if err := mod.Drain(ctx, time.Second); err != nil {
+		t.Fatalf("Drain = %v", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("Drain returned while handle was still running")
+	}
+	if mod.active.Load() != 0 {
+		t.Errorf("active = %d after drain", mod.active.Load())
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Drain waited past the in-flight call")
+	}
+}
+
+// slowSubscriberWasm subscribes to "t" in init(); on_message logs version,
+// then blocks for ms in a request nobody answers.
+func slowSubscriberWasm(version string, ms int32) []byte {
+	f := &wasmFixture{}
+	subFn := f.imp("subscribe", []byte{i32, i32, i32}, []byte{i32})
+	logFn := f.imp("log", []byte{i32, i32}, nil)
+	reqFn := f.imp("request", []byte{i32, i32, i32, i32, i32, i32, i32}, []byte{i32})
+	f.memory(1).dataAt(0, []byte("t")).dataAt(16, []byte("nobody")).dataAt(32, []byte(version))
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	f.fn("on_message", []byte{i32, i32}, nil, nil, ops(
+		i32Const(32), i32Const(int32(len(version))), call(logFn),
+		i32Const(16), i32Const(6), i32Const(0), i32Const(0), i32Const(ms), i32Const(64), i32Const(68),
+		call(reqFn), drop(),
+	)...)
+	f.fn("init", nil, nil, nil, ops(
+		i32Const(0), i32Const(1), i32Const(0), call(subFn), drop(),
+	)...)
+	return f.bytes()
+}
+
+func TestWasiServer_SwapRetiresOldModuleOffTheBus(t *testing.T) {
+	var mu sync.Mutex
+	handled := map[string]int{}
+	srv := New().SetAppRootDir(t.TempDir()).SetDrainTimeout(5 * time.Second).SetLogger(func(msg ...any) {
+		if len(msg) == 2 && msg[0] == "[WASI]" {
+			mu.Lock()
+			handled[msg[1].(string)]++
+			mu.Unlock()
+		}
+	})
+	if err := srv.swapModule("users", slowSubscriberWasm("v1", 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Steady traffic keeps a call in flight on v1 at all times.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				srv.bus.Publish("t", binary.Message{Payload: []byte("x")})
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := srv.swapModule("users", slowSubscriberWasm("v2", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("swap took %s: old module kept receiving messages while draining", d)
+	}
+	mu.Lock()
+	before := handled["v1"]
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if handled["v1"] != before {
+		t.Errorf("v1 handled %d messages after it was replaced", handled["v1"]-before)
+	}
+	if handled["v2"] == 0 {
+		t.Error("v2 handled no messages")
+	}
+}
+
+func TestModule_DrainTimeoutWithCallTimeout(t *testing.T) {
+	f := &wasmFixture{}
+	f.memory(1)
+	f.fn("malloc", []byte{i32}, []byte{i32}, nil, i32Const(1024)...)
+	// drain spins forever: loop { br 0 }
+	f.fn("drain", nil, []byte{i32}, nil, ops(
+		[]byte{0x03, 0x40, 0x0c, 0x00, 0x0b},
+		i32Const(0),
+	)...)
+
+	ctx := context.Background()
+	cfg := LoadConfig{Limits: Limits{CallTimeout: time.Second}}
+	mod, err := LoadWithConfig(ctx, "spin", f.bytes(), NewHostBuilder(bus.New(), nil, nil), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close(ctx)
+	if err := mod.Drain(ctx, 50*time.Millisecond); !errors.Is(err, ErrDrainTimeout) {
+		t.Errorf("Drain = %v, want ErrDrainTimeout", err)
+	}
+}
+
+func TestWsHub_InboundToBus(t *testing.T) {
+	b := bus.New()
+	received := make(chan binary.Message, 1)
+	b.Subscribe("ws.chat", func(msg binary.Message) {
+		received <- msg
+	})
+
+	hub := &wsHub{
+		clients:       make(map[string]map[*wsConn]bool),
+		bus:           b,
+		inboundPrefix: defaultWSInboundPrefix,
+	}
+	mux := http.NewServeMux()
+	hub.RegisterRoute(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+server.URL[4:]+"/ws?topic=chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	// Application JSON with its own "op" field is not a control frame.
+	for _, sent := range []string{"hello-server", `{"op":"typing","user":"ann"}`} {
+		if err := c.Write(ctx, websocket.MessageText, []byte(sent)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if string(msg.Payload) != sent || msg.Topic != "ws.chat" {
+				t.Errorf("bus received %+v, want %q", msg, sent)
+			}
+		case <-ctx.Done():
+			t.Fatalf("client message %q not published to the bus", sent)
+		}
+	}
+}
+
+func TestWsHub_ControlProtocol(t *testing.T) {
+	b := bus.New()
+	published := make(chan binary.Message, 1)
+	b.Subscribe("ws.b", func(msg binary.Message) {
+		published <- msg
+	})
+
+	hub := &wsHub{
+		clients:       make(map[string]map[*wsConn]bool),
+		bus:           b,
+		inboundPrefix: defaultWSInboundPrefix,
+	}
+	mux := http.NewServeMux()
+	hub.RegisterRoute(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// No ?topic=: the connection joins topics only through control frames.
+	c, _, err := websocket.Dial(ctx, "ws"+server.URL[4:]+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	send := func(ctl wsControl) {
+		data, _ := json.Marshal(ctl)
+		if err := c.Write(ctx, websocket.MessageText, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func() wsControl {
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ctl wsControl
+		if err := json.Unmarshal(data, &ctl); err != nil {
+			t.Fatalf("non-control frame %q", data)
+		}
+		return ctl
+	}
+
+	send(wsControl{Op: "subscribe", Topic: "a"})
+	send(wsControl{Op: "subscribe", Topic: "b"})
+	if got := recv(); got.Op != "subscribed" || got.Topic != "a" {
+		t.Fatalf("ack = %+v", got)
+	}
+	recv()
+
+	hub.Broadcast("a", []byte("to-a"))
+	if got := recv(); got.Op != "message" || got.Topic != "a" || string(got.Data) != "to-a" {
+		t.Errorf("message = %+v", got)
+	}
+
+	send(wsControl{Op: "unsubscribe", Topic: "a"})
+	if got := recv(); got.Op != "unsubscribed" {
+		t.Fatalf("ack = %+v", got)
+	}
+	hub.Broadcast("a", []byte("dropped"))
+	hub.Broadcast("b", []byte("to-b"))
+	if got := recv(); got.Topic != "b" || string(got.Data) != "to-b" {
+		t.Errorf("after unsubscribe got %+v, want message on b", got)
+	}
+
+	send(wsControl{Op: "publish", Topic: "b", Data: []byte("from-client")})
+	select {
+	case msg := <-published:
+		if string(msg.Payload) != "from-client" {
+			t.Errorf("bus received %q", msg.Payload)
+		}
+	case <-ctx.Done():
+		t.Fatal("publish frame not relayed to the bus")
+	}
+}
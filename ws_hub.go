@@ -2,25 +2,67 @@ package wasi
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/tinywasm/binary"
 	"github.com/tinywasm/bus"
 )
 
 type wsConn struct {
 	conn *websocket.Conn
-	send chan []byte
+	send chan wsFrame
+
+	// topic is the ?topic= the connection was opened with; it receives raw frames.
+	// Topics joined through control frames receive wsControl "message" frames.
+	topic  string
+	topics map[string]bool // every topic joined, guarded by wsHub.mu
+}
+
+type wsFrame struct {
+	typ  websocket.MessageType
+	data []byte
+}
+
+// wsControl is the JSON text frame of the multi-topic control protocol.
+//
+//	client → server  {"op":"subscribe","topic":"a"}
+//	                 {"op":"unsubscribe","topic":"a"}
+//	                 {"op":"publish","topic":"a","data":"<base64>"}
+//	server → client  {"op":"subscribed","topic":"a"}
+//	                 {"op":"unsubscribed","topic":"a"}
+//	                 {"op":"message","topic":"a","data":"<base64>"}
+//	                 {"op":"error","error":"..."}
+type wsControl struct {
+	Op    string `json:"op"`
+	Topic string `json:"topic,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
 }
 
+// wsClientOps are the control ops a client may send.
+var wsClientOps = map[string]bool{"subscribe": true, "unsubscribe": true, "publish": true}
+
 type wsHub struct {
 	clients map[string]map[*wsConn]bool
 	mu      sync.RWMutex
 	bus     bus.Bus
+
+	// inboundPrefix is prepended to a connection's topic to form the bus topic
+	// its client messages are published on: /ws?topic=chat → "ws.chat".
+	inboundPrefix string
+
+	metrics *Metrics
+	open    map[*wsConn]bool // every open /ws connection, guarded by mu
+	closing bool             // set by closeAll; new connections are refused
 }
 
+// defaultWSInboundPrefix is the bus topic prefix for browser → server messages.
+const defaultWSInboundPrefix = "ws."
+
 func (h *wsHub) RegisterRoute(mux *http.ServeMux) {
 	mux.HandleFunc("/ws", h.handleWS)
 }
@@ -34,21 +76,29 @@ func (h *wsHub) Broadcast(topic string, msg []byte) {
 		return
 	}
 
+	var framed []byte
 	for client := range clients {
+		frame := wsFrame{typ: websocket.MessageBinary, data: msg}
+		if client.topic != topic {
+			if framed == nil {
+				framed, _ = json.Marshal(wsControl{Op: "message", Topic: topic, Data: msg})
+			}
+			frame = wsFrame{typ: websocket.MessageText, data: framed}
+		}
 		select {
-		case client.send <- msg:
+		case client.send <- frame:
 		default:
 			// Buffer full, drop message
+			h.metrics.add("wasi_ws_dropped_total", 1, topic)
 		}
 	}
 }
 
+// handleWS serves /ws. With ?topic= the connection joins that topic and exchanges
+// raw frames on it; with or without it, the client may join and leave further
+// topics at runtime through wsControl text frames.
 func (h *wsHub) handleWS(w http.ResponseWriter, r *http.Request) {
 	topic := r.URL.Query().Get("topic")
-	if topic == "" {
-		http.Error(w, "topic required", http.StatusBadRequest)
-		return
-	}
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true, // Allow cross-origin for dev
@@ -58,33 +108,94 @@ func (h *wsHub) handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	conn := &wsConn{
-		conn: c,
-		send: make(chan []byte, 256),
+		conn:   c,
+		send:   make(chan wsFrame, 256),
+		topic:  topic,
+		topics: make(map[string]bool),
 	}
 
-	h.register(topic, conn)
+	if !h.track(conn) {
+		c.Close(websocket.StatusGoingAway, "server shutting down")
+		return
+	}
+	defer h.untrack(conn)
+
+	if topic != "" {
+		h.register(topic, conn)
+	}
 
 	// Start write pump
 	go conn.writePump()
 
-	// Read loop to handle close frames
+	// Read loop: relay client messages to the bus until the connection closes
 	defer func() {
-		h.unregister(topic, conn)
+		h.unregisterAll(conn)
 		c.Close(websocket.StatusNormalClosure, "")
 	}()
 
 	for {
-		_, _, err := c.Read(context.Background())
+		typ, data, err := c.Read(context.Background())
 		if err != nil {
 			break
 		}
+		if typ == websocket.MessageText {
+			// On a ?topic= connection only the client ops are control frames;
+			// other JSON, even with an "op" field, is relayed as before.
+			var ctl wsControl
+			if json.Unmarshal(data, &ctl) == nil && ctl.Op != "" && (topic == "" || wsClientOps[ctl.Op]) {
+				h.handleControl(conn, ctl)
+				continue
+			}
+		}
+		if topic != "" {
+			h.publishInbound(topic, data)
+		}
 	}
 }
 
+// handleControl applies one control frame from conn and acknowledges it.
+func (h *wsHub) handleControl(conn *wsConn, ctl wsControl) {
+	if ctl.Topic == "" {
+		conn.reply(wsControl{Op: "error", Error: "topic required"})
+		return
+	}
+	switch ctl.Op {
+	case "subscribe":
+		h.register(ctl.Topic, conn)
+		conn.reply(wsControl{Op: "subscribed", Topic: ctl.Topic})
+	case "unsubscribe":
+		h.unregister(ctl.Topic, conn)
+		conn.reply(wsControl{Op: "unsubscribed", Topic: ctl.Topic})
+	case "publish":
+		h.publishInbound(ctl.Topic, ctl.Data)
+	default:
+		conn.reply(wsControl{Op: "error", Topic: ctl.Topic, Error: "unknown op: " + ctl.Op})
+	}
+}
+
+// reply queues a control frame for the client, dropping it if the buffer is full.
+func (c *wsConn) reply(ctl wsControl) {
+	data, _ := json.Marshal(ctl)
+	select {
+	case c.send <- wsFrame{typ: websocket.MessageText, data: data}:
+	default:
+	}
+}
+
+// publishInbound publishes a client message on inboundPrefix+topic, where
+// modules subscribed via the subscribe host function receive it in on_message.
+func (h *wsHub) publishInbound(topic string, data []byte) {
+	if h.bus == nil {
+		return
+	}
+	busTopic := h.inboundPrefix + topic
+	h.bus.Publish(busTopic, binary.Message{Topic: busTopic, Payload: data})
+}
+
 func (c *wsConn) writePump() {
-	for msg := range c.send {
+	for frame := range c.send {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		err := c.conn.Write(ctx, websocket.MessageBinary, msg)
+		err := c.conn.Write(ctx, frame.typ, frame.data)
 		cancel()
 		if err != nil {
 			return
@@ -92,6 +203,56 @@ func (c *wsConn) writePump() {
 	}
 }
 
+// track records conn as open; it reports false once the hub is closing.
+func (h *wsHub) track(conn *wsConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		return false
+	}
+	if h.open == nil {
+		h.open = make(map[*wsConn]bool)
+	}
+	h.open[conn] = true
+	return true
+}
+
+func (h *wsHub) untrack(conn *wsConn) {
+	h.mu.Lock()
+	delete(h.open, conn)
+	h.mu.Unlock()
+}
+
+func (h *wsHub) clientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.open)
+}
+
+// closeAll sends a going-away close frame to every client and waits until
+// their connections are gone or ctx is done.
+func (h *wsHub) closeAll(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	conns := make([]*wsConn, 0, len(h.open))
+	for conn := range h.open {
+		conns = append(conns, conn)
+	}
+	h.mu.Unlock()
+
+	for _, conn := range conns {
+		go conn.conn.Close(websocket.StatusGoingAway, "server shutting down")
+	}
+	for h.clientCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
 func (h *wsHub) register(topic string, conn *wsConn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -103,18 +264,17 @@ func (h *wsHub) register(topic string, conn *wsConn) {
 		h.clients[topic] = make(map[*wsConn]bool)
 	}
 	h.clients[topic][conn] = true
+	if conn.topics == nil {
+		conn.topics = make(map[string]bool)
+	}
+	conn.topics[topic] = true
 }
 
 func (h *wsHub) unregister(topic string, conn *wsConn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if clients, ok := h.clients[topic]; ok {
-		delete(clients, conn)
-		if len(clients) == 0 {
-			delete(h.clients, topic)
-		}
-	}
+	h.removeLocked(topic, conn)
 	// close channel to stop writePump?
 	// But writePump might be writing.
 	// We can't close channel if multiple writers (Broadcast).
@@ -128,3 +288,23 @@ func (h *wsHub) unregister(topic string, conn *wsConn) {
 	// So we should not close the channel, let the GC handle it, or use a closing signal.
 	// Actually, if connection is closed, Write will fail, writePump will return.
 }
+
+// unregisterAll removes conn from every topic it joined.
+func (h *wsHub) unregisterAll(conn *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for topic := range conn.topics {
+		h.removeLocked(topic, conn)
+	}
+}
+
+func (h *wsHub) removeLocked(topic string, conn *wsConn) {
+	if clients, ok := h.clients[topic]; ok {
+		delete(clients, conn)
+		if len(clients) == 0 {
+			delete(h.clients, topic)
+		}
+	}
+	delete(conn.topics, topic)
+}